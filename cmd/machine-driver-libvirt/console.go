@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/code-ready/machine-driver-libvirt/pkg/libvirt"
+	"golang.org/x/sys/unix"
+)
+
+// Ctrl+]
+const consoleEscape = 0x1d
+
+// makeRaw puts the terminal in raw mode and returns a function restoring
+// its previous state
+func makeRaw(fd int) (func(), error) {
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	saved := *termios
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		return nil, err
+	}
+	return func() {
+		_ = unix.IoctlSetTermios(fd, unix.TCSETS, &saved)
+	}, nil
+}
+
+// escapeReader returns io.EOF once the console escape character is read
+type escapeReader struct {
+	r io.Reader
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == consoleEscape {
+			return i, io.EOF
+		}
+	}
+	return n, err
+}
+
+// attachConsole connects the terminal to the VM serial console
+func attachConsole(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s console <machine name>\n", os.Args[0])
+		return 2
+	}
+	driver := libvirt.NewDriver(args[0], "").(*libvirt.Driver)
+	console, err := driver.OpenConsole(false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open console of %s: %v\n", args[0], err)
+		return 1
+	}
+	defer console.Close()
+
+	fmt.Fprintf(os.Stderr, "Connected to %s console (escape character is ^])\n", args[0])
+	restore, err := makeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to set terminal in raw mode: %v\n", err)
+		return 1
+	}
+	defer restore()
+
+	go func() {
+		_, _ = io.Copy(os.Stdout, console)
+	}()
+	_, _ = io.Copy(console, &escapeReader{r: os.Stdin})
+	return 0
+}
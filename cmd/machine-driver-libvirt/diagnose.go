@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/code-ready/machine-driver-libvirt/pkg/libvirt"
+)
+
+// loadMachineConfig reads the driver configuration from the machine
+// config.json file written by libmachine
+func loadMachineConfig(driver *libvirt.Driver, storePath string) error {
+	data, err := ioutil.ReadFile(filepath.Join(storePath, "machines", driver.MachineName, "config.json"))
+	if err != nil {
+		return err
+	}
+	var host struct {
+		Driver json.RawMessage
+	}
+	if err := json.Unmarshal(data, &host); err != nil {
+		return err
+	}
+	return json.Unmarshal(host.Driver, driver)
+}
+
+// diagnose collects a diagnostic bundle for the machine
+func diagnose(args []string) int {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s diagnose <machine name> <output.tar.gz> [store path]\n", os.Args[0])
+		return 2
+	}
+	storePath := ""
+	if len(args) == 3 {
+		storePath = args[2]
+	}
+	driver := libvirt.NewDriver(args[0], storePath).(*libvirt.Driver)
+	if storePath != "" {
+		if err := loadMachineConfig(driver, storePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load %s configuration, continuing with defaults: %v\n", args[0], err)
+		}
+	}
+	if err := driver.CollectDiagnosticsToFile(args[1]); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to collect diagnostics for %s: %v\n", args[0], err)
+		return 1
+	}
+	fmt.Printf("Diagnostics written to %s\n", args[1])
+	return 0
+}
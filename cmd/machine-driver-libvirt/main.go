@@ -3,17 +3,46 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/code-ready/machine-driver-libvirt/pkg/libvirt"
 	"github.com/code-ready/machine/libmachine/drivers/plugin"
 )
 
+const guestExecTimeout = 5 * time.Minute
+
 func main() {
 	if len(os.Args) > 1 {
-		if os.Args[1] == "version" {
+		switch os.Args[1] {
+		case "version":
 			fmt.Printf("Driver version: %s\n", libvirt.DriverVersion)
 			os.Exit(0)
+		case "exec":
+			os.Exit(guestExec(os.Args[2:]))
+		case "console":
+			os.Exit(attachConsole(os.Args[2:]))
+		case "diagnose":
+			os.Exit(diagnose(os.Args[2:]))
 		}
 	}
 	plugin.RegisterDriver(libvirt.NewDriver("default", "path"))
 }
+
+// guestExec runs a command in the VM through the QEMU guest agent
+func guestExec(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s exec <machine name> <command> [args...]\n", os.Args[0])
+		return 2
+	}
+	driver := libvirt.NewDriver(args[0], "").(*libvirt.Driver)
+	driver.GuestAgent = true
+
+	result, err := driver.GuestExec(args[1], args[2:], guestExecTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run %s in %s: %v\n", args[1], args[0], err)
+		return 1
+	}
+	_, _ = os.Stdout.Write(result.Stdout)
+	_, _ = os.Stderr.Write(result.Stderr)
+	return result.ExitCode
+}
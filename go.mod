@@ -7,6 +7,7 @@ require (
 	github.com/libvirt/libvirt-go-xml v6.8.0+incompatible
 	github.com/sirupsen/logrus v1.7.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
 
@@ -0,0 +1,84 @@
+package libvirt
+
+import (
+	"fmt"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AcceleratorKVM  = "kvm"
+	AcceleratorTCG  = "tcg"
+	AcceleratorAuto = "auto"
+)
+
+// CPU models emulated when KVM is not available. Nehalem provides the
+// x86-64-v2 instruction set required by recent guests.
+var tcgCPUModels = map[string]string{
+	ArchX86_64:  "Nehalem",
+	ArchAArch64: "cortex-a57",
+}
+
+func (d *Driver) getAccelerator() string {
+	if d.Accelerator == "" {
+		return AcceleratorKVM
+	}
+	return d.Accelerator
+}
+
+func (d *Driver) checkAccelerator() error {
+	switch d.getAccelerator() {
+	case AcceleratorKVM, AcceleratorTCG, AcceleratorAuto:
+		return nil
+	default:
+		return &CheckError{
+			Check:  "accelerator",
+			Reason: fmt.Sprintf("unsupported accelerator '%s'", d.Accelerator),
+			Hint:   "Use kvm, tcg or auto",
+		}
+	}
+}
+
+// resolveAccelerator returns the accelerator to use for the VM, either kvm
+// or tcg. In auto mode, kvm is used when libvirt reports kvm support.
+func resolveAccelerator(accelerator string, caps *libvirtxml.Caps) (string, error) {
+	switch accelerator {
+	case AcceleratorKVM, AcceleratorTCG:
+		return accelerator, nil
+	case AcceleratorAuto:
+		if arch := getHostArchGuest(caps); arch != nil && hasDomainType(arch, "kvm") {
+			return AcceleratorKVM, nil
+		}
+		return AcceleratorTCG, nil
+	default:
+		return "", fmt.Errorf("unsupported accelerator: %s", accelerator)
+	}
+}
+
+// usesKVM returns false when the VM runs, or will run, with software emulation
+func (d *Driver) usesKVM() bool {
+	if d.accelerator != "" {
+		return d.accelerator == AcceleratorKVM
+	}
+	return d.getAccelerator() != AcceleratorTCG
+}
+
+func (d *Driver) setupAccelerator(caps *libvirtxml.Caps) error {
+	accelerator, err := resolveAccelerator(d.getAccelerator(), caps)
+	if err != nil {
+		return err
+	}
+	if accelerator == AcceleratorTCG {
+		log.Warnf("KVM is not used, the VM will run with software emulation and will be very slow")
+	}
+	d.accelerator = accelerator
+	return nil
+}
+
+func domainType(d *Driver) string {
+	if !d.usesKVM() {
+		return "qemu"
+	}
+	return "kvm"
+}
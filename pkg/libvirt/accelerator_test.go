@@ -0,0 +1,75 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveAccelerator(t *testing.T) {
+	caps := &libvirtxml.Caps{
+		Host: libvirtxml.CapsHost{
+			CPU: &libvirtxml.CapsHostCPU{
+				Arch: "x86_64",
+			},
+		},
+		Guests: []libvirtxml.CapsGuest{
+			{
+				OSType: "hvm",
+				Arch: libvirtxml.CapsGuestArch{
+					Name: "x86_64",
+					Domains: []libvirtxml.CapsGuestDomain{
+						{Type: "qemu"},
+					},
+				},
+			},
+		},
+	}
+	accelerator, err := resolveAccelerator(AcceleratorAuto, caps)
+	assert.NoError(t, err)
+	assert.Equal(t, AcceleratorTCG, accelerator)
+
+	accelerator, err = resolveAccelerator(AcceleratorKVM, caps)
+	assert.NoError(t, err)
+	assert.Equal(t, AcceleratorKVM, accelerator)
+
+	caps.Guests[0].Arch.Domains = append(caps.Guests[0].Arch.Domains, libvirtxml.CapsGuestDomain{Type: "kvm"})
+	accelerator, err = resolveAccelerator(AcceleratorAuto, caps)
+	assert.NoError(t, err)
+	assert.Equal(t, AcceleratorKVM, accelerator)
+
+	_, err = resolveAccelerator("hvf", caps)
+	assert.Error(t, err)
+}
+
+func TestCheckAccelerator(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkAccelerator())
+	d.Accelerator = AcceleratorAuto
+	assert.NoError(t, d.checkAccelerator())
+	d.Accelerator = "hvf"
+	assert.True(t, errors.Is(d.checkAccelerator(), ErrHostCheckFailed))
+}
+
+func TestTCGTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.accelerator = AcceleratorTCG
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^<domain type="qemu">`, xml)
+	assert.Contains(t, xml, `<cpu match="exact" mode="custom">
+    <model fallback="allow">Nehalem</model>
+  </cpu>`)
+}
+
+func TestAArch64TCGTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.arch = ArchAArch64
+	d.accelerator = AcceleratorTCG
+	xml, err := domainXML(d, "virt")
+	assert.NoError(t, err)
+	assert.Regexp(t, `^<domain type="qemu">`, xml)
+	assert.Contains(t, xml, `<model fallback="allow">cortex-a57</model>`)
+}
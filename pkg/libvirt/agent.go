@@ -0,0 +1,145 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	guestAgentChannel = "org.qemu.guest_agent.0"
+
+	// Timeout in seconds for guest agent commands
+	guestAgentTimeout = 10
+
+	// How long after Start the VM is reported as starting while its guest
+	// agent is not connected, the guest image may have no agent. It must be
+	// shorter than the libmachine wait for the running state (3 minutes).
+	guestAgentBootTimeout = 2 * time.Minute
+)
+
+func guestAgentChannelXML() libvirtxml.DomainChannel {
+	return libvirtxml.DomainChannel{
+		Source: &libvirtxml.DomainChardevSource{
+			UNIX: &libvirtxml.DomainChardevSourceUNIX{
+				Mode: "bind",
+			},
+		},
+		Target: &libvirtxml.DomainChannelTarget{
+			VirtIO: &libvirtxml.DomainChannelTargetVirtIO{
+				Name: guestAgentChannel,
+			},
+		},
+	}
+}
+
+// guestAgentConnected looks at the guest agent channel state in the live
+// domain XML, libvirt sets it to 'connected' once the agent is running
+func guestAgentConnected(domainXML string) (bool, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(domainXML); err != nil {
+		return false, err
+	}
+	if domain.Devices == nil {
+		return false, nil
+	}
+	for _, channel := range domain.Devices.Channels {
+		if channel.Target == nil || channel.Target.VirtIO == nil {
+			continue
+		}
+		if channel.Target.VirtIO.Name == guestAgentChannel {
+			return channel.Target.VirtIO.State == "connected", nil
+		}
+	}
+	return false, nil
+}
+
+// GuestAgentConnected returns true once the guest agent of the running VM is
+// connected
+func (d *Driver) GuestAgentConnected() (bool, error) {
+	if err := d.validateGuestAgent(); err != nil {
+		return false, err
+	}
+	xml, err := d.vm.GetXMLDesc(libvirt.DomainXMLFlags(0))
+	if err != nil {
+		return false, err
+	}
+	return guestAgentConnected(xml)
+}
+
+// waitingForGuestAgent returns true while a VM started at startedAt may still
+// be booting. A VM not started by the driver is considered booted.
+func waitingForGuestAgent(startedAt, now time.Time) bool {
+	return !startedAt.IsZero() && now.Sub(startedAt) < guestAgentBootTimeout
+}
+
+func (d *Driver) validateGuestAgent() error {
+	if !d.GuestAgent {
+		return fmt.Errorf("guest agent channel is not enabled for machine '%s'", d.MachineName)
+	}
+	return d.validateVMRef()
+}
+
+type guestAgentCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// guestAgentCommand runs a command through the guest agent and unmarshals
+// its 'return' value into result, if non nil
+func (d *Driver) guestAgentCommand(command string, arguments interface{}, result interface{}) error {
+	if err := d.validateGuestAgent(); err != nil {
+		return err
+	}
+	cmd, err := json.Marshal(guestAgentCommand{
+		Execute:   command,
+		Arguments: arguments,
+	})
+	if err != nil {
+		return err
+	}
+	log.Debugf("Running guest agent command %s", command)
+	reply, err := d.vm.QemuAgentCommand(string(cmd), libvirt.DomainQemuAgentCommandTimeout(guestAgentTimeout), 0)
+	if err != nil {
+		return fmt.Errorf("guest agent command %s failed: %w", command, err)
+	}
+	if result == nil {
+		return nil
+	}
+	var response struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(reply), &response); err != nil {
+		return fmt.Errorf("invalid reply to guest agent command %s: %w", command, err)
+	}
+	return json.Unmarshal(response.Return, result)
+}
+
+// GuestAgentPing returns nil once the guest agent answers, which means the
+// guest OS finished booting
+func (d *Driver) GuestAgentPing() error {
+	return d.guestAgentCommand("guest-ping", nil, nil)
+}
+
+// FreezeFilesystems freezes all the guest filesystems so that a consistent
+// disk snapshot can be taken
+func (d *Driver) FreezeFilesystems() error {
+	if err := d.validateGuestAgent(); err != nil {
+		return err
+	}
+	log.Debugf("Freezing filesystems of %s", d.MachineName)
+	return d.vm.FSFreeze(nil, 0)
+}
+
+// ThawFilesystems thaws the guest filesystems frozen by FreezeFilesystems
+func (d *Driver) ThawFilesystems() error {
+	if err := d.validateGuestAgent(); err != nil {
+		return err
+	}
+	log.Debugf("Thawing filesystems of %s", d.MachineName)
+	return d.vm.FSThaw(nil, 0)
+}
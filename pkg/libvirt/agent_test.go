@@ -0,0 +1,78 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuestAgentTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.GuestAgent = true
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<channel type="unix">
+      <source mode="bind"></source>
+      <target type="virtio" name="org.qemu.guest_agent.0"></target>
+    </channel>`)
+
+	connected, err := guestAgentConnected(xml)
+	assert.NoError(t, err)
+	assert.False(t, connected)
+}
+
+func TestGuestAgentConnected(t *testing.T) {
+	connected, err := guestAgentConnected(`<domain type="kvm">
+  <name>domain</name>
+  <devices>
+    <channel type="unix">
+      <source mode="bind" path="/var/lib/libvirt/qemu/channel/target/domain-1-crc/org.qemu.guest_agent.0"></source>
+      <target type="virtio" name="org.qemu.guest_agent.0" state="connected"></target>
+    </channel>
+  </devices>
+</domain>`)
+	assert.NoError(t, err)
+	assert.True(t, connected)
+}
+
+func TestWaitingForGuestAgent(t *testing.T) {
+	now := time.Now()
+	assert.True(t, waitingForGuestAgent(now.Add(-time.Minute), now))
+	// The guest may have no agent, it's considered booted after a while
+	assert.False(t, waitingForGuestAgent(now.Add(-guestAgentBootTimeout), now))
+	assert.False(t, waitingForGuestAgent(time.Time{}, now))
+}
+
+func TestGuestExecStatusResult(t *testing.T) {
+	status := guestExecStatus{
+		Exited:   true,
+		ExitCode: 1,
+		OutData:  "aGVsbG8K",
+		ErrData:  "",
+	}
+	result, err := status.result()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ExitCode)
+	assert.Equal(t, "hello\n", string(result.Stdout))
+	assert.Empty(t, result.Stderr)
+
+	status = guestExecStatus{
+		Exited: true,
+		Signal: 9,
+	}
+	result, err = status.result()
+	assert.NoError(t, err)
+	assert.Equal(t, 137, result.ExitCode)
+}
+
+func TestGuestExecArguments(t *testing.T) {
+	data, err := json.Marshal(guestExecArguments{Path: "/usr/bin/uptime", CaptureOutput: true})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"path": "/usr/bin/uptime", "capture-output": true}`, string(data))
+
+	data, err = json.Marshal(guestExecArguments{Path: "/usr/bin/ls", Arg: []string{"-l"}, CaptureOutput: true})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"path": "/usr/bin/ls", "arg": ["-l"], "capture-output": true}`, string(data))
+}
@@ -0,0 +1,159 @@
+package libvirt
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ArchX86_64  = "x86_64"
+	ArchAArch64 = "aarch64"
+)
+
+// Go to libvirt architecture names
+var goArchs = map[string]string{
+	"amd64": ArchX86_64,
+	"arm64": ArchAArch64,
+}
+
+// getArch returns the host architecture reported by libvirt, or the one the
+// driver was built for before it's known
+func (d *Driver) getArch() string {
+	if d.arch != "" {
+		return d.arch
+	}
+	if arch, ok := goArchs[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+func (d *Driver) isX86() bool {
+	arch := d.getArch()
+	return arch == ArchX86_64 || arch == "i686"
+}
+
+// defaultMachineType returns the machine type preferred for arch. aarch64
+// has no default machine type, while x86 falls back to qemu's default.
+func defaultMachineType(arch string) (machineType string, required bool) {
+	if arch == ArchAArch64 {
+		return "virt", true
+	}
+	return "q35", false
+}
+
+// isI440FX returns true for the x86 "pc" machine types, qemu's default when
+// no machine type is set
+func isI440FX(machineType string) bool {
+	return machineType == "" || machineType == "pc" ||
+		(strings.HasPrefix(machineType, "pc-") && !strings.HasPrefix(machineType, "pc-q35"))
+}
+
+// supportedMachineTypes returns the machine type names and aliases qemu
+// supports for arch, for all domain types
+func supportedMachineTypes(arch *libvirtxml.CapsGuestArch) []string {
+	names := map[string]bool{}
+	add := func(machines []libvirtxml.CapsGuestMachine) {
+		for _, machine := range machines {
+			names[machine.Name] = true
+			if machine.Canonical != "" {
+				names[machine.Canonical] = true
+			}
+		}
+	}
+	add(arch.Machines)
+	for _, domain := range arch.Domains {
+		add(domain.Machines)
+	}
+	var machineTypes []string
+	for name := range names {
+		machineTypes = append(machineTypes, name)
+	}
+	sort.Strings(machineTypes)
+	return machineTypes
+}
+
+func hasMachineType(machineTypes []string, machineType string) bool {
+	for _, name := range machineTypes {
+		if name == machineType {
+			return true
+		}
+	}
+	return false
+}
+
+// getMachineType returns the configured machine type if qemu supports it,
+// or the preferred one for the host architecture. An empty machine type
+// means qemu's default.
+func (d *Driver) getMachineType(caps *libvirtxml.Caps) (string, error) {
+	capsGuestArch := getHostArchGuest(caps)
+	if capsGuestArch == nil {
+		return "", fmt.Errorf("Could not find a %s hypervisor with 'hvm' capabilities", caps.Host.CPU.Arch)
+	}
+	log.Debugf("Found %s hypervisor with 'hvm' capabilities", caps.Host.CPU.Arch)
+	machineTypes := supportedMachineTypes(capsGuestArch)
+
+	if d.MachineType != "" {
+		if !hasMachineType(machineTypes, d.MachineType) {
+			return "", &CheckError{
+				Check:  "machine-type",
+				Reason: fmt.Sprintf("machine type %s is not supported on %s, supported machine types: %s", d.MachineType, caps.Host.CPU.Arch, strings.Join(machineTypes, ", ")),
+				Hint:   "Use one of the supported machine types, or leave it empty to use the default one",
+			}
+		}
+		return d.MachineType, nil
+	}
+
+	machineType, required := defaultMachineType(caps.Host.CPU.Arch)
+	if hasMachineType(machineTypes, machineType) {
+		log.Debugf("Found %s machine type", machineType)
+		return machineType, nil
+	}
+	if required {
+		return "", &CheckError{
+			Check:  "machine-type",
+			Reason: fmt.Sprintf("qemu doesn't support the %s machine type, required on %s", machineType, caps.Host.CPU.Arch),
+			Hint:   "Update qemu",
+		}
+	}
+	log.Debugf("No %s machine type", machineType)
+	return "", nil
+}
+
+// hostMachineType returns the machine type for PreCreateCheck, errors are
+// reported by the machine type check
+func (d *Driver) hostMachineType(conn *libvirt.Connect) string {
+	caps, err := getCapabilities(conn)
+	if err != nil {
+		return ""
+	}
+	machineType, _ := d.getMachineType(caps)
+	return machineType
+}
+
+func domainFeatures(d *Driver) *libvirtxml.DomainFeatureList {
+	if !d.isX86() {
+		features := &libvirtxml.DomainFeatureList{
+			ACPI: &libvirtxml.DomainFeature{},
+		}
+		if d.getArch() == ArchAArch64 {
+			features.GIC = &libvirtxml.DomainFeatureGIC{}
+			if d.usesKVM() {
+				// Same interrupt controller as the host
+				features.GIC.Version = "host"
+			}
+		}
+		return features
+	}
+	return &libvirtxml.DomainFeatureList{
+		ACPI: &libvirtxml.DomainFeature{},
+		APIC: &libvirtxml.DomainFeatureAPIC{},
+		PAE:  &libvirtxml.DomainFeature{},
+	}
+}
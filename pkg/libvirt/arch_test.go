@@ -0,0 +1,89 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func newArchTestCaps(arch string, machines ...string) *libvirtxml.Caps {
+	caps := &libvirtxml.Caps{
+		Host: libvirtxml.CapsHost{
+			CPU: &libvirtxml.CapsHostCPU{
+				Arch: arch,
+			},
+		},
+		Guests: []libvirtxml.CapsGuest{
+			{
+				OSType: "hvm",
+				Arch: libvirtxml.CapsGuestArch{
+					Name: arch,
+				},
+			},
+		},
+	}
+	for _, machine := range machines {
+		caps.Guests[0].Arch.Machines = append(caps.Guests[0].Arch.Machines, libvirtxml.CapsGuestMachine{Name: machine})
+	}
+	return caps
+}
+
+func TestGetMachineType(t *testing.T) {
+	d := newTestDriver()
+	machineType, err := d.getMachineType(newArchTestCaps(ArchX86_64, "pc-q35-5.1", "q35", "pc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "q35", machineType)
+
+	machineType, err = d.getMachineType(newArchTestCaps(ArchX86_64, "pc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", machineType)
+
+	machineType, err = d.getMachineType(newArchTestCaps(ArchAArch64, "virt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "virt", machineType)
+
+	_, err = d.getMachineType(newArchTestCaps(ArchAArch64))
+	assert.Error(t, err)
+
+	d.MachineType = "pc"
+	machineType, err = d.getMachineType(newArchTestCaps(ArchX86_64, "q35", "pc"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pc", machineType)
+
+	d.MachineType = "microvm"
+	_, err = d.getMachineType(newArchTestCaps(ArchX86_64, "q35", "pc"))
+	assert.True(t, errors.Is(err, ErrHostCheckFailed))
+	assert.Contains(t, err.Error(), "supported machine types: pc, q35")
+}
+
+func TestAArch64Templating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.arch = ArchAArch64
+	d.accelerator = AcceleratorKVM
+
+	xml, err := domainXML(d, "virt")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<os firmware="efi">
+    <type machine="virt">hvm</type>
+    <loader secure="no"></loader>
+    <nvram>/store/machines/domain/nvram.fd</nvram>`)
+	assert.Contains(t, xml, `<features>
+    <acpi></acpi>
+    <gic version="host"></gic>
+  </features>`)
+	assert.Contains(t, xml, `<cpu mode="host-passthrough"></cpu>`)
+	assert.Contains(t, xml, `<clock offset="utc"></clock>`)
+	assert.NotContains(t, xml, `<pae>`)
+}
+
+func TestIsI440FX(t *testing.T) {
+	assert.True(t, isI440FX("pc"))
+	assert.True(t, isI440FX("pc-i440fx-6.2"))
+	assert.True(t, isI440FX("pc-1.2"))
+	assert.True(t, isI440FX(""))
+	assert.False(t, isI440FX("q35"))
+	assert.False(t, isI440FX("pc-q35-6.2"))
+}
@@ -0,0 +1,261 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// cdrom buses, sata is the default on x86, ide on the i440fx (pc) machine
+// types and scsi on aarch64
+const (
+	CDROMBusSATA = "sata"
+	CDROMBusSCSI = "scsi"
+	CDROMBusIDE  = "ide"
+
+	// Two IDE buses with a master and a slave drive each
+	maxIDEDrives = 4
+)
+
+// Valid BootOrder entries
+var bootDevices = map[string]bool{
+	"hd":      true,
+	"cdrom":   true,
+	"network": true,
+}
+
+func (d *Driver) getCDROMBus(machineType string) string {
+	if d.CDROMBus == "" {
+		// Neither the aarch64 virt machine nor i440fx have an AHCI
+		// controller
+		if d.getArch() == ArchAArch64 {
+			return CDROMBusSCSI
+		}
+		if d.isX86() && isI440FX(machineType) {
+			return CDROMBusIDE
+		}
+		return CDROMBusSATA
+	}
+	return d.CDROMBus
+}
+
+// cdromTarget returns the guest device name of the nth cdrom drive
+func cdromTarget(bus string, index int) string {
+	if bus == CDROMBusIDE {
+		return fmt.Sprintf("hd%c", 'a'+index)
+	}
+	return fmt.Sprintf("sd%c", 'a'+index)
+}
+
+// cdromImages returns the images of all the cdrom drives, the cloud-init
+// seed image comes after the user images. An empty path is an empty drive.
+func (d *Driver) cdromImages() []string {
+	images := append([]string{}, d.ISOImages...)
+	if d.usesCloudInit() {
+		images = append(images, d.getCloudInitSeedPath())
+	}
+	return images
+}
+
+func domainCDROM(bus string, index int, image string) libvirtxml.DomainDisk {
+	disk := libvirtxml.DomainDisk{
+		Device: "cdrom",
+		Driver: &libvirtxml.DomainDiskDriver{
+			Name: "qemu",
+			Type: "raw",
+		},
+		Target: &libvirtxml.DomainDiskTarget{
+			Dev: cdromTarget(bus, index),
+			Bus: bus,
+		},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+	}
+	if image != "" {
+		disk.Source = &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: image,
+			},
+		}
+	}
+	return disk
+}
+
+func domainCDROMs(d *Driver, domain *libvirtxml.Domain) {
+	images := d.cdromImages()
+	if len(images) == 0 {
+		return
+	}
+	bus := d.getCDROMBus(domain.OS.Type.Machine)
+	for i, image := range images {
+		domain.Devices.Disks = append(domain.Devices.Disks, domainCDROM(bus, i, image))
+	}
+	if bus == CDROMBusSCSI {
+		domain.Devices.Controllers = append(domain.Devices.Controllers, libvirtxml.DomainController{
+			Type:  "scsi",
+			Model: "virtio-scsi",
+		})
+	}
+}
+
+func domainBootDevices(d *Driver) []libvirtxml.DomainBootDevice {
+	if len(d.BootOrder) == 0 {
+		return []libvirtxml.DomainBootDevice{
+			{
+				Dev: "hd",
+			},
+		}
+	}
+	var devices []libvirtxml.DomainBootDevice
+	for _, dev := range d.BootOrder {
+		devices = append(devices, libvirtxml.DomainBootDevice{
+			Dev: dev,
+		})
+	}
+	return devices
+}
+
+// checkCDROMBus validates the cdrom bus against the resolved machine type
+func (d *Driver) checkCDROMBus(machineType string) error {
+	bus := d.getCDROMBus(machineType)
+	switch bus {
+	case CDROMBusSCSI:
+		return nil
+	case CDROMBusSATA:
+		if !d.isX86() || !isI440FX(machineType) {
+			return nil
+		}
+	case CDROMBusIDE:
+		if d.isX86() && isI440FX(machineType) {
+			if len(d.cdromImages()) > maxIDEDrives {
+				return &CheckError{
+					Check:  "cdrom",
+					Reason: "too many cdrom drives for the ide bus",
+					Hint:   fmt.Sprintf("Use %d cdrom images or less, or the scsi bus", maxIDEDrives),
+				}
+			}
+			return nil
+		}
+	default:
+		return &CheckError{
+			Check:  "cdrom",
+			Reason: fmt.Sprintf("unsupported cdrom bus '%s'", d.CDROMBus),
+			Hint:   "Use sata, scsi or ide",
+		}
+	}
+	if machineType == "" {
+		machineType = "default"
+	}
+	return &CheckError{
+		Check:  "cdrom",
+		Reason: fmt.Sprintf("the %s machine type has no %s controller", machineType, bus),
+		Hint:   "Use the scsi bus, or leave the cdrom bus empty to pick one supported by the machine type",
+	}
+}
+
+func (d *Driver) checkCDROMs(machineType string) error {
+	if err := d.checkCDROMBus(machineType); err != nil {
+		return err
+	}
+	if len(d.cdromImages()) > 26 {
+		return &CheckError{
+			Check:  "cdrom",
+			Reason: "too many cdrom drives",
+			Hint:   "Use 26 cdrom images or less",
+		}
+	}
+	for _, image := range d.ISOImages {
+		if image == "" {
+			continue
+		}
+		if _, err := os.Stat(image); err != nil {
+			return &CheckError{
+				Check:  "cdrom",
+				Reason: fmt.Sprintf("%s is not accessible: %v", image, err),
+				Hint:   "Fix the ISO image paths",
+			}
+		}
+	}
+	for _, dev := range d.BootOrder {
+		if !bootDevices[dev] {
+			return &CheckError{
+				Check:  "boot-order",
+				Reason: fmt.Sprintf("unsupported boot device '%s'", dev),
+				Hint:   "Use hd, cdrom or network",
+			}
+		}
+	}
+	return nil
+}
+
+// changeMedia replaces the media of the cdrom drive with the given target
+// device name, an empty image ejects the media
+func (d *Driver) changeMedia(target, image string) error {
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(0)
+	if err != nil {
+		return err
+	}
+	domain := &libvirtxml.Domain{}
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return err
+	}
+	var disk *libvirtxml.DomainDisk
+	for i := range domain.Devices.Disks {
+		candidate := &domain.Devices.Disks[i]
+		if candidate.Device == "cdrom" && candidate.Target != nil && candidate.Target.Dev == target {
+			disk = candidate
+			break
+		}
+	}
+	if disk == nil {
+		return fmt.Errorf("no cdrom drive %s in %s", target, d.MachineName)
+	}
+	disk.Source = nil
+	if image != "" {
+		disk.Source = &libvirtxml.DomainDiskSource{
+			File: &libvirtxml.DomainDiskSourceFile{
+				File: image,
+			},
+		}
+	}
+	diskXML, err := disk.Marshal()
+	if err != nil {
+		return err
+	}
+
+	flags := libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	active, err := d.vm.IsActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	log.Debugf("Changing %s media to '%s'", target, image)
+	if err := d.vm.UpdateDeviceFlags(diskXML, flags); err != nil {
+		return err
+	}
+	for i := range d.ISOImages {
+		if cdromTarget(disk.Target.Bus, i) == target {
+			d.ISOImages[i] = image
+		}
+	}
+	return nil
+}
+
+// InsertMedia inserts the image in the cdrom drive with the given target
+// device name ("sda", "sdb"..., or "hda", "hdb"... on the ide bus), replacing
+// the current media
+func (d *Driver) InsertMedia(target, image string) error {
+	return d.changeMedia(target, image)
+}
+
+// EjectMedia empties the cdrom drive with the given target device name
+func (d *Driver) EjectMedia(target string) error {
+	return d.changeMedia(target, "")
+}
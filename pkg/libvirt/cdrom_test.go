@@ -0,0 +1,86 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCDROMTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.ISOImages = []string{"/isos/rescue.iso", ""}
+	d.CDROMBus = CDROMBusSCSI
+	d.CloudInitUserData = "#cloud-config\n"
+	d.BootOrder = []string{"cdrom", "hd"}
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<boot dev="cdrom"></boot>
+    <boot dev="hd"></boot>`)
+	assert.Contains(t, xml, `<disk type="file" device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <source file="/isos/rescue.iso"></source>
+      <target dev="sda" bus="scsi"></target>
+      <readonly></readonly>
+    </disk>
+    <disk device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <target dev="sdb" bus="scsi"></target>
+      <readonly></readonly>
+    </disk>
+    <disk type="file" device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <source file="/store/machines/domain/cloud-init-seed.iso"></source>
+      <target dev="sdc" bus="scsi"></target>
+      <readonly></readonly>
+    </disk>`)
+	assert.Contains(t, xml, `<controller type="scsi" model="virtio-scsi"></controller>`)
+}
+
+func TestCheckCDROMs(t *testing.T) {
+	d := newTestDriver()
+	d.ISOImages = []string{""}
+	d.BootOrder = []string{"cdrom", "hd"}
+	assert.NoError(t, d.checkCDROMs("q35"))
+
+	d.CDROMBus = "floppy"
+	assert.Error(t, d.checkCDROMs("q35"))
+
+	d.CDROMBus = ""
+	d.BootOrder = []string{"floppy"}
+	assert.Error(t, d.checkCDROMs("q35"))
+
+	d.BootOrder = nil
+	d.ISOImages = []string{"/nonexistent/rescue.iso"}
+	assert.Error(t, d.checkCDROMs("q35"))
+}
+
+func TestI440FXCDROMs(t *testing.T) {
+	d := newTestDriver()
+	d.ISOImages = []string{""}
+	assert.Equal(t, CDROMBusIDE, d.getCDROMBus("pc"))
+	assert.Equal(t, CDROMBusIDE, d.getCDROMBus(""))
+	assert.Equal(t, CDROMBusSATA, d.getCDROMBus("pc-q35-6.2"))
+	assert.NoError(t, d.checkCDROMs("pc-i440fx-6.2"))
+
+	xml, err := domainXML(d, "pc")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<disk device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <target dev="hda" bus="ide"></target>
+      <readonly></readonly>
+    </disk>`)
+
+	// i440fx has no AHCI controller, and q35 no IDE one
+	d.CDROMBus = CDROMBusSATA
+	assert.Error(t, d.checkCDROMs("pc"))
+	d.CDROMBus = CDROMBusIDE
+	assert.Error(t, d.checkCDROMs("q35"))
+	d.CDROMBus = CDROMBusSCSI
+	assert.NoError(t, d.checkCDROMs("pc"))
+
+	d.CDROMBus = ""
+	d.ISOImages = []string{"", "", "", "", ""}
+	assert.Error(t, d.checkCDROMs("pc"))
+}
@@ -0,0 +1,326 @@
+package libvirt
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const kvmDevice = "/dev/kvm"
+
+// Minimum versions, in libvirt's major * 1,000,000 + minor * 1000 + release format
+const (
+	// serial console <log> element
+	minLibvirtVersion = 1003003
+	minQemuVersion    = 2006000
+
+	minLibvirtVersionVSock = 4004000
+	minQemuVersionVSock    = 2008000
+
+	minQemuVersionQ35 = 2004000
+
+	// firmware="efi" autoselection
+	minLibvirtVersionFirmware = 5002000
+
+	// <sysinfo type="fwcfg">
+	minLibvirtVersionFWCfg = 6005000
+
+	// TPM 2.0 emulator
+	minLibvirtVersionTPM         = 4005000
+	minQemuVersionTPM            = 2012000
+	minLibvirtVersionUndefineTPM = 8009000
+)
+
+// hostCheck is a single PreCreateCheck verification. Checks flagged as
+// warnings are logged but don't prevent the machine creation.
+type hostCheck struct {
+	name    string
+	warning bool
+	check   func() error
+}
+
+// checkKVMDevice is only a warning, qemu is run by libvirt as its own user
+// so the current user doesn't need access to the device. The kvm capability
+// check tells if libvirt can use it.
+func checkKVMDevice() error {
+	if err := unix.Access(kvmDevice, unix.R_OK|unix.W_OK); err != nil {
+		return &CheckError{
+			Check:  "kvm-device",
+			Reason: fmt.Sprintf("%s is not accessible: %v", kvmDevice, err),
+			Hint:   "Enable virtualization in the BIOS/UEFI settings, load the kvm_intel or kvm_amd module and make sure libvirt can access the device",
+		}
+	}
+	return nil
+}
+
+func getCapabilities(conn *libvirt.Connect) (*libvirtxml.Caps, error) {
+	capsXML, err := conn.GetCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	caps := &libvirtxml.Caps{}
+	err = caps.Unmarshal(capsXML)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing libvirt capabilities: %w", err)
+	}
+	if caps.Host.CPU == nil {
+		return nil, fmt.Errorf("libvirt capabilities are missing the host CPU")
+	}
+	return caps, nil
+}
+
+// getHostArchGuest returns the 'hvm' guest capabilities for the host architecture
+func getHostArchGuest(caps *libvirtxml.Caps) *libvirtxml.CapsGuestArch {
+	for i := range caps.Guests {
+		guest := &caps.Guests[i]
+		if guest.OSType == "hvm" && guest.Arch.Name == caps.Host.CPU.Arch {
+			return &guest.Arch
+		}
+	}
+	return nil
+}
+
+func hasDomainType(arch *libvirtxml.CapsGuestArch, domainType string) bool {
+	for _, domain := range arch.Domains {
+		if domain.Type == domainType {
+			return true
+		}
+	}
+	return false
+}
+
+func checkKVMDomainType(caps *libvirtxml.Caps) error {
+	arch := getHostArchGuest(caps)
+	if arch == nil || !hasDomainType(arch, "kvm") {
+		return &CheckError{
+			Check:  "kvm-capability",
+			Reason: fmt.Sprintf("libvirt cannot create kvm domains for the %s architecture", caps.Host.CPU.Arch),
+			Hint:   "Install the qemu-kvm package and restart libvirtd",
+		}
+	}
+	return nil
+}
+
+func checkVersion(component, feature string, version, minVersion uint32) error {
+	if version >= minVersion {
+		return nil
+	}
+	return &CheckError{
+		Check:  fmt.Sprintf("%s-version", component),
+		Reason: fmt.Sprintf("%s %s is too old for %s, %s or newer is required", component, formatVersion(version), feature, formatVersion(minVersion)),
+		Hint:   fmt.Sprintf("Update %s, or disable %s", component, feature),
+	}
+}
+
+func (d *Driver) checkVersions(conn *libvirt.Connect, machineType string) error {
+	libVersion, err := conn.GetLibVersion()
+	if err != nil {
+		return err
+	}
+	qemuVersion, err := conn.GetVersion()
+	if err != nil {
+		return err
+	}
+	if err := checkVersion("libvirt", "this driver", libVersion, minLibvirtVersion); err != nil {
+		return err
+	}
+	if err := checkVersion("qemu", "this driver", qemuVersion, minQemuVersion); err != nil {
+		return err
+	}
+	if d.VSock {
+		if err := checkVersion("libvirt", "vsock", libVersion, minLibvirtVersionVSock); err != nil {
+			return err
+		}
+		if err := checkVersion("qemu", "vsock", qemuVersion, minQemuVersionVSock); err != nil {
+			return err
+		}
+	}
+	if d.usesEFI() && d.FirmwareLoader == "" {
+		if err := checkVersion("libvirt", "UEFI firmware autoselection", libVersion, minLibvirtVersionFirmware); err != nil {
+			return err
+		}
+	}
+	if d.IgnitionConfig != "" {
+		if err := checkVersion("libvirt", "Ignition configs", libVersion, minLibvirtVersionFWCfg); err != nil {
+			return err
+		}
+	}
+	if d.TPM {
+		if err := checkVersion("libvirt", "the TPM emulator", libVersion, minLibvirtVersionTPM); err != nil {
+			return err
+		}
+		if err := checkVersion("qemu", "the TPM emulator", qemuVersion, minQemuVersionTPM); err != nil {
+			return err
+		}
+	}
+	if machineType == "q35" {
+		if err := checkVersion("qemu", "the q35 machine type", qemuVersion, minQemuVersionQ35); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkQemuImg() error {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		return &CheckError{
+			Check:  "qemu-img",
+			Reason: "qemu-img was not found in $PATH, disk images will be full copies of the bundle image",
+			Hint:   "Install the qemu-img package",
+		}
+	}
+	return nil
+}
+
+// checkDiskSpace compares the maximum size of the disk image to the free
+// space of the pool. It's only a warning: the image is a thin qcow2 overlay,
+// it only fills the pool when the guest writes to all of the disk.
+func checkDiskSpace(pool string, available, capacity uint64) error {
+	if capacity == 0 || available >= capacity {
+		return nil
+	}
+	return &CheckError{
+		Check:  "disk-space",
+		Reason: fmt.Sprintf("storage pool %s has %d MiB available, the disk image can grow up to %d MiB", pool, available/(1024*1024), capacity/(1024*1024)),
+		Hint:   "Free up some disk space or use a smaller disk size",
+	}
+}
+
+func (d *Driver) checkPoolDiskSpace() error {
+	pool, err := d.getPool()
+	if err != nil {
+		return err
+	}
+	defer pool.Free() // nolint:errcheck
+	info, err := pool.GetInfo()
+	if err != nil {
+		return err
+	}
+	return checkDiskSpace(d.getStoragePoolName(), info.Available, d.DiskCapacity)
+}
+
+// checkMemory compares the requested memory size to the host memory, all
+// sizes are in bytes
+func checkMemory(requested, total uint64) error {
+	if requested <= total {
+		return nil
+	}
+	return &CheckError{
+		Check:  "memory",
+		Reason: fmt.Sprintf("%d MiB of memory requested, the host only has %d MiB", requested/(1024*1024), total/(1024*1024)),
+		Hint:   "Use a smaller memory size",
+	}
+}
+
+func checkFreeMemory(requested, free uint64) error {
+	if requested <= free {
+		return nil
+	}
+	return &CheckError{
+		Check:  "free-memory",
+		Reason: fmt.Sprintf("%d MiB of memory requested, only %d MiB are free", requested/(1024*1024), free/(1024*1024)),
+		Hint:   "Close some applications or use a smaller memory size",
+	}
+}
+
+func (d *Driver) checkHostMemory(conn *libvirt.Connect) error {
+	nodeInfo, err := conn.GetNodeInfo()
+	if err != nil {
+		return err
+	}
+	/* NodeInfo.Memory is in kiB */
+	return checkMemory(convertMiBToKiB(d.Memory)*1024, nodeInfo.Memory*1024)
+}
+
+func (d *Driver) checkHostFreeMemory(conn *libvirt.Connect) error {
+	free, err := conn.GetFreeMemory()
+	if err != nil {
+		return err
+	}
+	return checkFreeMemory(convertMiBToKiB(d.Memory)*1024, free)
+}
+
+func (d *Driver) hostChecks(conn *libvirt.Connect) []hostCheck {
+	checks := []hostCheck{
+		{name: "accelerator", check: d.checkAccelerator},
+	}
+	if d.getAccelerator() == AcceleratorKVM {
+		checks = append(checks,
+			hostCheck{name: "kvm device", warning: true, check: checkKVMDevice},
+			hostCheck{name: "kvm capability", check: func() error {
+				caps, err := getCapabilities(conn)
+				if err != nil {
+					return err
+				}
+				return checkKVMDomainType(caps)
+			}},
+		)
+	}
+	if d.TPM {
+		checks = append(checks, hostCheck{name: "swtpm", check: checkSwtpm})
+	}
+	return append(checks, []hostCheck{
+		{name: "machine type", check: func() error {
+			caps, err := getCapabilities(conn)
+			if err != nil {
+				return err
+			}
+			_, err = d.getMachineType(caps)
+			return err
+		}},
+		{name: "cpu configuration", check: d.validateCPUConfig},
+		{name: "numa configuration", check: func() error {
+			if !d.hasNUMATuning() {
+				return nil
+			}
+			caps, err := getCapabilities(conn)
+			if err != nil {
+				return err
+			}
+			return d.checkNUMA(caps)
+		}},
+		{name: "firmware", check: func() error {
+			return d.checkFirmware(d.hostMachineType(conn))
+		}},
+		{name: "kernel", check: d.checkKernelBoot},
+		{name: "first boot config", check: d.checkFirstBootConfig},
+		{name: "cdrom", check: func() error {
+			return d.checkCDROMs(d.hostMachineType(conn))
+		}},
+		{name: "graphics", check: d.checkGraphics},
+		{name: "vsock", check: d.checkVSock},
+		{name: "domain overrides", check: d.checkDomainOverrides},
+		{name: "versions", check: func() error {
+			return d.checkVersions(conn, d.hostMachineType(conn))
+		}},
+		{name: "qemu-img", warning: true, check: checkQemuImg},
+		{name: "disk space", warning: true, check: d.checkPoolDiskSpace},
+		{name: "memory", check: func() error { return d.checkHostMemory(conn) }},
+		{name: "free memory", warning: true, check: func() error { return d.checkHostFreeMemory(conn) }},
+	}...)
+}
+
+// runHostChecks runs all the checks, and returns the first failure
+func runHostChecks(checks []hostCheck) error {
+	var firstErr error
+	for _, check := range checks {
+		log.Debugf("Checking %s", check.name)
+		err := check.check()
+		if err == nil {
+			continue
+		}
+		if check.warning {
+			log.Warnf("%v", err)
+			continue
+		}
+		log.Debugf("%s check failed: %v", check.name, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,73 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckKVMDomainType(t *testing.T) {
+	caps := &libvirtxml.Caps{
+		Host: libvirtxml.CapsHost{
+			CPU: &libvirtxml.CapsHostCPU{
+				Arch: "x86_64",
+			},
+		},
+		Guests: []libvirtxml.CapsGuest{
+			{
+				OSType: "hvm",
+				Arch: libvirtxml.CapsGuestArch{
+					Name: "x86_64",
+					Domains: []libvirtxml.CapsGuestDomain{
+						{Type: "qemu"},
+					},
+				},
+			},
+		},
+	}
+	err := checkKVMDomainType(caps)
+	assert.True(t, errors.Is(err, ErrHostCheckFailed))
+
+	caps.Guests[0].Arch.Domains = append(caps.Guests[0].Arch.Domains, libvirtxml.CapsGuestDomain{Type: "kvm"})
+	assert.NoError(t, checkKVMDomainType(caps))
+}
+
+func TestCheckVersion(t *testing.T) {
+	assert.NoError(t, checkVersion("libvirt", "vsock", 6010000, minLibvirtVersionVSock))
+	err := checkVersion("libvirt", "vsock", 4000000, minLibvirtVersionVSock)
+	assert.EqualError(t, err, "libvirt 4.0.0 is too old for vsock, 4.4.0 or newer is required. Update libvirt, or disable vsock")
+}
+
+func TestCheckResources(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	assert.NoError(t, checkDiskSpace("crc", 40*gib, 31*gib))
+	assert.NoError(t, checkDiskSpace("crc", 40*gib, 0))
+	assert.Error(t, checkDiskSpace("crc", 20*gib, 31*gib))
+
+	assert.NoError(t, checkMemory(9*gib, 16*gib))
+	assert.Error(t, checkMemory(9*gib, 8*gib))
+}
+
+func TestRunHostChecks(t *testing.T) {
+	failure := errors.New("failure")
+	err := runHostChecks([]hostCheck{
+		{name: "warning", warning: true, check: func() error { return errors.New("warning") }},
+		{name: "ok", check: func() error { return nil }},
+		{name: "failure", check: func() error { return failure }},
+	})
+	assert.Equal(t, failure, err)
+}
+
+func TestHostCheckWarnings(t *testing.T) {
+	d := newTestDriver()
+	warnings := map[string]bool{}
+	for _, check := range d.hostChecks(nil) {
+		warnings[check.name] = check.warning
+	}
+	// Neither prevents the VM from running
+	assert.True(t, warnings["kvm device"])
+	assert.True(t, warnings["disk space"])
+	assert.False(t, warnings["kvm capability"])
+}
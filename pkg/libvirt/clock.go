@@ -0,0 +1,263 @@
+package libvirt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	timeSyncRetries       = 10
+	timeSyncRetryInterval = 3 * time.Second
+
+	hostSuspendPollInterval = 5 * time.Second
+	// Scheduling delays don't make the clocks diverge, any difference
+	// above this is a host suspend
+	hostSuspendThreshold = 2 * time.Second
+)
+
+// domainClock returns the guest clock, the timers are only configurable on x86
+func domainClock(d *Driver) *libvirtxml.DomainClock {
+	if !d.isX86() {
+		return &libvirtxml.DomainClock{
+			Offset: "utc",
+		}
+	}
+	return &libvirtxml.DomainClock{
+		Offset: "utc",
+		Timer: []libvirtxml.DomainTimer{
+			{
+				Name:       "rtc",
+				TickPolicy: "catchup",
+			},
+			{
+				Name:       "pit",
+				TickPolicy: "delay",
+			},
+			{
+				Name:    "hpet",
+				Present: "no",
+			},
+			{
+				Name:    "kvmclock",
+				Present: "yes",
+			},
+		},
+	}
+}
+
+func setGuestTime(vm *libvirt.Domain, name string) error {
+	now := time.Now()
+	log.Debugf("Setting guest time of %s to %s", name, now)
+	return vm.SetTime(now.Unix(), uint(now.Nanosecond()), 0)
+}
+
+// SyncTime sets the guest clock to the host time through the guest agent
+func (d *Driver) SyncTime() error {
+	if err := d.validateGuestAgent(); err != nil {
+		return err
+	}
+	return setGuestTime(d.vm, d.MachineName)
+}
+
+// syncTimeWithRetry waits for the guest agent to be reachable after a
+// resume or a restore before syncing the guest clock. It gives up early
+// when done is closed.
+func syncTimeWithRetry(syncTime func() error, done <-chan struct{}) error {
+	var err error
+	for i := 0; i < timeSyncRetries; i++ {
+		if err = syncTime(); err == nil {
+			return nil
+		}
+		log.Debugf("Failed to sync guest time %d/%d: %v", i, timeSyncRetries, err)
+		select {
+		case <-done:
+			return fmt.Errorf("failed to sync guest time: %w", err)
+		case <-time.After(timeSyncRetryInterval):
+		}
+	}
+	return fmt.Errorf("failed to sync guest time: %w", err)
+}
+
+// Resume unpauses the VM and resyncs its clock
+func (d *Driver) Resume() error {
+	log.Debugf("Resuming VM %s", d.MachineName)
+	if err := d.validateVMRef(); err != nil {
+		return err
+	}
+	if err := d.vm.Resume(); err != nil {
+		return err
+	}
+	if !d.GuestAgent {
+		return nil
+	}
+	return syncTimeWithRetry(d.SyncTime, nil)
+}
+
+func needsTimeSync(event *libvirt.DomainEventLifecycle) bool {
+	switch event.Event {
+	case libvirt.DOMAIN_EVENT_RESUMED:
+		return true
+	case libvirt.DOMAIN_EVENT_STARTED:
+		return libvirt.DomainEventStartedDetailType(event.Detail) == libvirt.DOMAIN_EVENT_STARTED_RESTORED
+	}
+	return false
+}
+
+var eventLoopOnce sync.Once
+
+// startEventLoop registers and runs the libvirt event loop, once for the
+// whole process. It must be called before opening the connections used
+// for events.
+func startEventLoop() error {
+	var err error
+	eventLoopOnce.Do(func() {
+		if err = libvirt.EventRegisterDefaultImpl(); err != nil {
+			return
+		}
+		go func() {
+			for {
+				if err := libvirt.EventRunDefaultImpl(); err != nil {
+					log.Warnf("Failed to run libvirt event loop: %v", err)
+					return
+				}
+			}
+		}()
+	})
+	return err
+}
+
+// suspendOffset returns for how long the host has been suspended since it
+// booted: CLOCK_BOOTTIME advances during suspend, CLOCK_MONOTONIC doesn't
+func suspendOffset() (time.Duration, error) {
+	var boottime, monotonic unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_BOOTTIME, &boottime); err != nil {
+		return 0, err
+	}
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &monotonic); err != nil {
+		return 0, err
+	}
+	return time.Duration(boottime.Nano() - monotonic.Nano()), nil
+}
+
+// hostResumed returns true when the suspend offset grew enough between two
+// polls for the host to have been suspended in between
+func hostResumed(previous, current time.Duration) bool {
+	return current-previous > hostSuspendThreshold
+}
+
+// WatchTimeSync resyncs the guest clock whenever the host resumes from
+// suspend, or libvirt reports that the VM was resumed or restored, until
+// done is closed. It must run in a long-lived process: the machine plugin
+// process exits along with its libmachine client. It uses its own libvirt
+// connection and domain handle, so the other driver methods can be called
+// while it runs.
+func (d *Driver) WatchTimeSync(done <-chan struct{}) error {
+	if !d.GuestAgent {
+		return fmt.Errorf("guest agent channel is not enabled for machine '%s'", d.MachineName)
+	}
+	if err := startEventLoop(); err != nil {
+		return err
+	}
+	conn, err := libvirt.NewConnect(connectionString)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	vm, err := conn.LookupDomainByName(d.MachineName)
+	if err != nil {
+		return err
+	}
+	defer vm.Free() // nolint:errcheck
+
+	syncTime := make(chan struct{}, 1)
+	requestSync := func() {
+		select {
+		case syncTime <- struct{}{}:
+		default:
+		}
+	}
+	lifecycleID, err := conn.DomainEventLifecycleRegister(vm, func(_ *libvirt.Connect, _ *libvirt.Domain, event *libvirt.DomainEventLifecycle) {
+		if needsTimeSync(event) {
+			log.Debugf("VM %s resumed, resyncing its clock", d.MachineName)
+			requestSync()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.DomainEventDeregister(lifecycleID) // nolint:errcheck
+
+	// The host suspend is invisible to libvirt, the guest is frozen
+	// with the qemu process and its clock is late after resume
+	offset, err := suspendOffset()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(hostSuspendPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			current, err := suspendOffset()
+			if err != nil {
+				log.Debugf("Failed to read the host clocks: %v", err)
+				continue
+			}
+			if hostResumed(offset, current) {
+				log.Debugf("Host resumed from suspend, resyncing the clock of VM %s", d.MachineName)
+				requestSync()
+			}
+			offset = current
+		case <-syncTime:
+			// agent calls must not be made from the event loop callbacks
+			err := syncTimeWithRetry(func() error {
+				return setGuestTime(vm, d.MachineName)
+			}, done)
+			if err != nil {
+				log.Warnf("%v", err)
+			}
+		}
+	}
+}
+
+// TimeSyncWatcher runs WatchTimeSync in the background
+type TimeSyncWatcher struct {
+	done   chan struct{}
+	exited chan struct{}
+	err    error
+}
+
+// StartTimeSync runs WatchTimeSync until the returned watcher is stopped
+func (d *Driver) StartTimeSync() *TimeSyncWatcher {
+	w := &TimeSyncWatcher{
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.exited)
+		w.err = d.WatchTimeSync(w.done)
+	}()
+	return w
+}
+
+// Stop stops watching for host resumes, and waits for an in-flight clock
+// sync to complete. It returns the error which ended the watch early, if any.
+func (w *TimeSyncWatcher) Stop() error {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	<-w.exited
+	return w.err
+}
@@ -0,0 +1,68 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainClock(t *testing.T) {
+	d := newTestDriver()
+	clock := domainClock(d)
+	assert.Equal(t, "utc", clock.Offset)
+	assert.Contains(t, clock.Timer, libvirtxml.DomainTimer{Name: "rtc", TickPolicy: "catchup"})
+	assert.Contains(t, clock.Timer, libvirtxml.DomainTimer{Name: "kvmclock", Present: "yes"})
+
+	d.arch = ArchAArch64
+	assert.Equal(t, &libvirtxml.DomainClock{Offset: "utc"}, domainClock(d))
+}
+
+func TestNeedsTimeSync(t *testing.T) {
+	assert.True(t, needsTimeSync(&libvirt.DomainEventLifecycle{
+		Event: libvirt.DOMAIN_EVENT_RESUMED,
+	}))
+	assert.True(t, needsTimeSync(&libvirt.DomainEventLifecycle{
+		Event:  libvirt.DOMAIN_EVENT_STARTED,
+		Detail: int(libvirt.DOMAIN_EVENT_STARTED_RESTORED),
+	}))
+	assert.False(t, needsTimeSync(&libvirt.DomainEventLifecycle{
+		Event:  libvirt.DOMAIN_EVENT_STARTED,
+		Detail: int(libvirt.DOMAIN_EVENT_STARTED_BOOTED),
+	}))
+	assert.False(t, needsTimeSync(&libvirt.DomainEventLifecycle{
+		Event: libvirt.DOMAIN_EVENT_SUSPENDED,
+	}))
+}
+
+func TestHostResumed(t *testing.T) {
+	assert.False(t, hostResumed(10*time.Second, 10*time.Second))
+	assert.False(t, hostResumed(10*time.Second, 10*time.Second+time.Millisecond))
+	assert.True(t, hostResumed(10*time.Second, 10*time.Minute))
+
+	_, err := suspendOffset()
+	assert.NoError(t, err)
+}
+
+func TestSyncTimeWithRetry(t *testing.T) {
+	calls := 0
+	assert.NoError(t, syncTimeWithRetry(func() error {
+		calls++
+		return nil
+	}, nil))
+	assert.Equal(t, 1, calls)
+
+	// Stopping the watcher doesn't wait for all the retries
+	calls = 0
+	done := make(chan struct{})
+	close(done)
+	err := syncTimeWithRetry(func() error {
+		calls++
+		return errors.New("agent not connected")
+	}, done)
+	assert.EqualError(t, err, "failed to sync guest time: agent not connected")
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,190 @@
+package libvirt
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	consoleLogFilename = "console.log"
+
+	// Number of console lines included in boot failure errors
+	consoleErrorLines = 20
+	// Only the end of the console log is read to get its last lines
+	consoleTailBytes = 64 * 1024
+)
+
+func (d *Driver) getConsoleLogPath() string {
+	return d.ResolveStorePath(consoleLogFilename)
+}
+
+// domainSerialConsole returns a pty serial port logging the guest output to
+// the machine directory, and the matching console
+func domainSerialConsole(d *Driver) ([]libvirtxml.DomainSerial, []libvirtxml.DomainConsole) {
+	var port uint
+	serial := libvirtxml.DomainSerial{
+		Source: &libvirtxml.DomainChardevSource{
+			Pty: &libvirtxml.DomainChardevSourcePty{},
+		},
+		Target: &libvirtxml.DomainSerialTarget{
+			Port: &port,
+		},
+		Log: &libvirtxml.DomainChardevLog{
+			File:   d.getConsoleLogPath(),
+			Append: "off",
+		},
+	}
+	console := libvirtxml.DomainConsole{
+		Source: &libvirtxml.DomainChardevSource{
+			Pty: &libvirtxml.DomainChardevSourcePty{},
+		},
+		Target: &libvirtxml.DomainConsoleTarget{
+			Type: "serial",
+			Port: &port,
+		},
+	}
+	return []libvirtxml.DomainSerial{serial}, []libvirtxml.DomainConsole{console}
+}
+
+// rotateConsoleLog keeps the console output of the previous boot around
+func (d *Driver) rotateConsoleLog() error {
+	logPath := d.getConsoleLogPath()
+	if _, err := os.Stat(logPath); os.IsNotExist(err) {
+		return nil
+	}
+	log.Debugf("Rotating console log %s", logPath)
+	return os.Rename(logPath, logPath+".1")
+}
+
+func lastLines(data []byte, n int) []byte {
+	data = bytes.TrimRight(data, "\n")
+	for i := len(data) - 1; i >= 0; i-- {
+		if data[i] != '\n' {
+			continue
+		}
+		n--
+		if n == 0 {
+			return data[i+1:]
+		}
+	}
+	return data
+}
+
+// GetConsoleLogTail returns the last lines of the VM serial console output
+func (d *Driver) GetConsoleLogTail(lines int) (string, error) {
+	f, err := os.Open(d.getConsoleLogPath())
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if fi.Size() > consoleTailBytes {
+		if _, err := f.Seek(-consoleTailBytes, io.SeekEnd); err != nil {
+			return "", err
+		}
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(lastLines(data, lines)), nil
+}
+
+// consoleStream exposes a libvirt console stream as an io.ReadWriteCloser
+type consoleStream struct {
+	stream *libvirt.Stream
+}
+
+func (c *consoleStream) Read(p []byte) (int, error) {
+	return c.stream.Recv(p)
+}
+
+func (c *consoleStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.stream.Send(p[written:])
+		if err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+func (c *consoleStream) Close() error {
+	_ = c.stream.Finish()
+	return c.stream.Free()
+}
+
+// OpenConsole connects to the VM serial console. With force set, an
+// existing console session is disconnected.
+func (d *Driver) OpenConsole(force bool) (io.ReadWriteCloser, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.NewStream(0)
+	if err != nil {
+		return nil, err
+	}
+	flags := libvirt.DOMAIN_CONSOLE_SAFE
+	if force {
+		flags |= libvirt.DOMAIN_CONSOLE_FORCE
+	}
+	if err := d.vm.OpenConsole("", stream, flags); err != nil {
+		_ = stream.Free()
+		return nil, err
+	}
+	return &consoleStream{stream: stream}, nil
+}
+
+// ServeConsole proxies the VM serial console to the clients connecting to a
+// Unix socket, one at a time, until done is closed
+func (d *Driver) ServeConsole(socketPath string, done <-chan struct{}) error {
+	_ = os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-done
+		_ = listener.Close()
+	}()
+	defer os.Remove(socketPath)
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+				return err
+			}
+		}
+		log.Debugf("Attaching console client to %s", d.MachineName)
+		console, err := d.OpenConsole(true)
+		if err != nil {
+			log.Warnf("Failed to open console: %v", err)
+			_ = client.Close()
+			continue
+		}
+		proxy(client, console)
+		_ = console.Close()
+		_ = client.Close()
+	}
+}
@@ -0,0 +1,13 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLastLines(t *testing.T) {
+	assert.Equal(t, "c\nd", string(lastLines([]byte("a\nb\nc\nd\n"), 2)))
+	assert.Equal(t, "a\nb", string(lastLines([]byte("a\nb"), 5)))
+	assert.Equal(t, "", string(lastLines([]byte(""), 5)))
+}
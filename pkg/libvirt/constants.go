@@ -1,5 +1,17 @@
 package libvirt
 
+import (
+	"github.com/libvirt/libvirt-go"
+)
+
+// VIR_DOMAIN_INTERFACE_ADDRESSES_SRC_ARP, available since libvirt 4.2.0 but
+// missing from the go bindings
+const domainInterfaceAddressesSrcARP = libvirt.DomainInterfaceAddressesSource(2)
+
+// VIR_DOMAIN_UNDEFINE_TPM, available since libvirt 8.9.0. 1 << 6 is
+// VIR_DOMAIN_UNDEFINE_KEEP_TPM.
+const domainUndefineTPM = libvirt.DomainUndefineFlagsValues(1 << 5)
+
 const (
 	DriverName    = "libvirt"
 	DriverVersion = "0.13.0"
@@ -7,4 +19,16 @@ const (
 	connectionString = "qemu:///system"
 	DefaultNetwork   = "crc"
 	DefaultPool      = "crc"
+
+	DefaultNetworkSubnet = "192.168.130.0/24"
+
+	// Namespace of the driver elements in the libvirt <metadata>
+	metadataNamespace = "https://github.com/code-ready/machine-driver-libvirt"
+	// Marks the networks created by the driver
+	networkMetadata = `<driver:network xmlns:driver="` + metadataNamespace + `"/>`
+
+	// Networking modes
+	NetworkModeNetwork = "network"
+	NetworkModeBridge  = "bridge"
+	NetworkModeDirect  = "direct"
 )
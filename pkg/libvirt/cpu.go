@@ -0,0 +1,163 @@
+package libvirt
+
+import (
+	"fmt"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	CPUModelHostPassthrough = "host-passthrough"
+	CPUModelHostModel       = "host-model"
+)
+
+// CPUFeature sets the policy (force, require, optional, disable or forbid)
+// of a guest CPU feature
+type CPUFeature struct {
+	Name   string
+	Policy string
+}
+
+var cpuFeaturePolicies = map[string]bool{
+	"force":    true,
+	"require":  true,
+	"optional": true,
+	"disable":  true,
+	"forbid":   true,
+}
+
+func (d *Driver) getCPUModel() string {
+	if d.CPUModel == "" {
+		return CPUModelHostPassthrough
+	}
+	return d.CPUModel
+}
+
+func (d *Driver) hasCPUTopology() bool {
+	return d.CPUSockets != 0 || d.CPUCores != 0 || d.CPUThreads != 0
+}
+
+func (d *Driver) validateCPUConfig() error {
+	for _, feature := range d.CPUFeatures {
+		if feature.Name == "" {
+			return &CheckError{
+				Check:  "cpu",
+				Reason: "CPU feature name cannot be empty",
+				Hint:   "Set the name of all the CPU features",
+			}
+		}
+		if !cpuFeaturePolicies[feature.Policy] {
+			return &CheckError{
+				Check:  "cpu",
+				Reason: fmt.Sprintf("invalid policy '%s' for CPU feature %s", feature.Policy, feature.Name),
+				Hint:   "Use force, require, optional, disable or forbid",
+			}
+		}
+	}
+	if !d.hasCPUTopology() {
+		return nil
+	}
+	if d.CPUSockets <= 0 || d.CPUCores <= 0 || d.CPUThreads <= 0 {
+		return &CheckError{
+			Check:  "cpu",
+			Reason: "CPU sockets, cores and threads must all be set",
+			Hint:   "Set the CPU sockets, cores and threads, or none of them",
+		}
+	}
+	if d.CPUSockets*d.CPUCores*d.CPUThreads != d.CPU {
+		return &CheckError{
+			Check: "cpu",
+			Reason: fmt.Sprintf("CPU topology (%d sockets, %d cores, %d threads) doesn't match the %d vCPUs",
+				d.CPUSockets, d.CPUCores, d.CPUThreads, d.CPU),
+			Hint: "Make sockets * cores * threads equal to the vCPU count",
+		}
+	}
+	return nil
+}
+
+// scaledCPUCores returns the cores per socket of the topology for a new vCPU
+// count, the sockets and threads per core are kept
+func (d *Driver) scaledCPUCores(cpus int) (int, error) {
+	perCore := d.CPUSockets * d.CPUThreads
+	if perCore <= 0 || cpus <= 0 || cpus%perCore != 0 {
+		return 0, fmt.Errorf("%d vCPUs can't be split in %d sockets with %d threads per core", cpus, d.CPUSockets, d.CPUThreads)
+	}
+	return cpus / perCore, nil
+}
+
+// setDomainVCPUs updates the vCPU count and topology of a domain definition
+func setDomainVCPUs(domain *libvirtxml.Domain, cpus uint, topology *libvirtxml.DomainCPUTopology) {
+	domain.VCPU = &libvirtxml.DomainVCPU{
+		Value: cpus,
+	}
+	if domain.CPU == nil {
+		domain.CPU = &libvirtxml.DomainCPU{}
+	}
+	domain.CPU.Topology = topology
+}
+
+// needsRdrandWorkaround returns true if rdrand must be hidden from the guest,
+// on AMD hosts where it can return broken values after a suspend/resume
+// https://bugzilla.redhat.com/show_bug.cgi?id=1806532
+func (d *Driver) needsRdrandWorkaround() bool {
+	if !d.usesKVM() || !d.isX86() {
+		return false
+	}
+	if d.hostCPU == nil {
+		// Host CPU unknown, be on the safe side
+		return true
+	}
+	return d.hostCPU.Vendor == "AMD"
+}
+
+func domainCPU(d *Driver) *libvirtxml.DomainCPU {
+	var cpu *libvirtxml.DomainCPU
+	switch model := d.getCPUModel(); {
+	case !d.usesKVM():
+		// host-passthrough is not supported by TCG
+		cpu = &libvirtxml.DomainCPU{}
+		if tcgModel, ok := tcgCPUModels[d.getArch()]; ok {
+			cpu = &libvirtxml.DomainCPU{
+				Mode:  "custom",
+				Match: "exact",
+				Model: &libvirtxml.DomainCPUModel{
+					Fallback: "allow",
+					Value:    tcgModel,
+				},
+			}
+		}
+	case model == CPUModelHostPassthrough || model == CPUModelHostModel:
+		cpu = &libvirtxml.DomainCPU{
+			Mode: model,
+		}
+	default:
+		cpu = &libvirtxml.DomainCPU{
+			Mode:  "custom",
+			Match: "exact",
+			Model: &libvirtxml.DomainCPUModel{
+				Fallback: "forbid",
+				Value:    model,
+			},
+		}
+	}
+	if d.hasCPUTopology() {
+		cpu.Topology = &libvirtxml.DomainCPUTopology{
+			Sockets: d.CPUSockets,
+			Cores:   d.CPUCores,
+			Threads: d.CPUThreads,
+		}
+	}
+	if d.needsRdrandWorkaround() {
+		cpu.Features = append(cpu.Features, libvirtxml.DomainCPUFeature{
+			Policy: "disable",
+			Name:   "rdrand",
+		})
+	}
+	for _, feature := range d.CPUFeatures {
+		cpu.Features = append(cpu.Features, libvirtxml.DomainCPUFeature{
+			Policy: feature.Policy,
+			Name:   feature.Name,
+		})
+	}
+	return cpu
+}
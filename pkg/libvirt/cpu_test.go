@@ -0,0 +1,97 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCPUTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.CPUModel = "Skylake-Client"
+	d.CPUFeatures = []CPUFeature{
+		{Name: "vmx", Policy: "require"},
+	}
+	d.CPUSockets = 2
+	d.CPUCores = 2
+	d.CPUThreads = 1
+	d.hostCPU = &libvirtxml.CapsHostCPU{
+		Vendor: "Intel",
+	}
+	assert.NoError(t, d.validateCPUConfig())
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu match="exact" mode="custom">
+    <model fallback="forbid">Skylake-Client</model>
+    <topology sockets="2" cores="2" threads="1"></topology>
+    <feature policy="require" name="vmx"></feature>
+  </cpu>`)
+}
+
+func TestCPURdrandWorkaround(t *testing.T) {
+	d := newTestDriver()
+	d.CPUModel = CPUModelHostModel
+	d.hostCPU = &libvirtxml.CapsHostCPU{
+		Vendor: "AMD",
+	}
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<cpu mode="host-model">
+    <feature policy="disable" name="rdrand"></feature>
+  </cpu>`)
+	// rdrand is an x86 feature
+	d.arch = ArchAArch64
+	assert.False(t, d.needsRdrandWorkaround())
+	xml, err = domainXML(d, "virt")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, "rdrand")
+}
+
+func TestValidateCPUConfig(t *testing.T) {
+	d := newTestDriver()
+	d.CPUSockets = 2
+	d.CPUCores = 4
+	d.CPUThreads = 1
+	err := d.validateCPUConfig()
+	assert.True(t, errors.Is(err, ErrHostCheckFailed))
+	assert.Contains(t, err.Error(), "doesn't match the 4 vCPUs")
+
+	d = newTestDriver()
+	d.CPUFeatures = []CPUFeature{
+		{Name: "vmx", Policy: "enable"},
+	}
+	assert.True(t, errors.Is(d.validateCPUConfig(), ErrHostCheckFailed))
+}
+
+func TestScaledCPUCores(t *testing.T) {
+	d := newTestDriver()
+	d.CPUSockets = 2
+	d.CPUCores = 1
+	d.CPUThreads = 2
+	assert.NoError(t, d.validateCPUConfig())
+
+	cores, err := d.scaledCPUCores(8)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, cores)
+	_, err = d.scaledCPUCores(6)
+	assert.Error(t, err)
+	_, err = d.scaledCPUCores(0)
+	assert.Error(t, err)
+}
+
+func TestSetDomainVCPUs(t *testing.T) {
+	domain := &libvirtxml.Domain{
+		VCPU: &libvirtxml.DomainVCPU{Value: 4},
+		CPU: &libvirtxml.DomainCPU{
+			Mode:     CPUModelHostPassthrough,
+			Topology: &libvirtxml.DomainCPUTopology{Sockets: 2, Cores: 1, Threads: 2},
+		},
+	}
+	setDomainVCPUs(domain, 8, &libvirtxml.DomainCPUTopology{Sockets: 2, Cores: 2, Threads: 2})
+	assert.Equal(t, uint(8), domain.VCPU.Value)
+	assert.Equal(t, CPUModelHostPassthrough, domain.CPU.Mode)
+	assert.Equal(t, &libvirtxml.DomainCPUTopology{Sockets: 2, Cores: 2, Threads: 2}, domain.CPU.Topology)
+}
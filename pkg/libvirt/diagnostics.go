@@ -0,0 +1,313 @@
+package libvirt
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "<redacted>"
+
+// Driver config fields which are not included as is in diagnostic bundles.
+// First boot configs, domain overrides and kernel arguments often embed
+// credentials.
+var secretConfigFields = map[string]bool{
+	"GraphicsPassword":       true,
+	"IgnitionConfig":         true,
+	"CloudInitUserData":      true,
+	"CloudInitMetaData":      true,
+	"CloudInitNetworkConfig": true,
+	"DomainXMLOverride":      true,
+	"DomainPatch":            true,
+	"QemuArgs":               true,
+	"KernelCmdline":          true,
+}
+
+// formatVersion converts a libvirt version number to a major.minor.release string
+func formatVersion(version uint32) string {
+	return fmt.Sprintf("%d.%d.%d", version/1000000, (version/1000)%1000, version%1000)
+}
+
+func isUnset(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// redactSecrets replaces the values of the secret fields of the JSON driver
+// config, unset fields are kept to show they are not used
+func redactSecrets(config map[string]interface{}) map[string]interface{} {
+	for key, value := range config {
+		if secretConfigFields[key] && !isUnset(value) {
+			config[key] = redacted
+		}
+	}
+	return config
+}
+
+// redactedConfig returns the driver config as JSON, with secrets redacted
+func redactedConfig(config interface{}) ([]byte, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var generic map[string]interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(redactSecrets(generic), "", "  ")
+}
+
+// redactDomainXML removes the secret config fields merged in the domain
+// definition. The XML override and patch can change any element, a domain
+// defined with them is left out of the bundle.
+func redactDomainXML(xml string, overrides bool) (string, error) {
+	if overrides {
+		return redacted + ": the domain is defined with a domain XML override or patch\n", nil
+	}
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(xml); err != nil {
+		return "", err
+	}
+	changed := false
+	if domain.OS != nil && domain.OS.Cmdline != "" {
+		domain.OS.Cmdline = redacted
+		changed = true
+	}
+	if domain.QEMUCommandline != nil {
+		for i := range domain.QEMUCommandline.Args {
+			domain.QEMUCommandline.Args[i].Value = redacted
+		}
+		for i := range domain.QEMUCommandline.Envs {
+			domain.QEMUCommandline.Envs[i].Value = redacted
+		}
+		changed = true
+	}
+	if !changed {
+		// Keep the elements unknown to libvirtxml
+		return xml, nil
+	}
+	return domain.Marshal()
+}
+
+type diagnosticsBundle struct {
+	tw *tar.Writer
+}
+
+func (b *diagnosticsBundle) addFile(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+// add stores the output of collect in the bundle, or the error it returned,
+// so that a single failure doesn't prevent collecting everything else
+func (b *diagnosticsBundle) add(name string, collect func() ([]byte, error)) error {
+	data, err := collect()
+	if err != nil {
+		log.Debugf("Failed to collect %s: %v", name, err)
+		return b.addFile(name+".error", []byte(err.Error()+"\n"))
+	}
+	return b.addFile(name, data)
+}
+
+func (d *Driver) diagnosticsDomainXML(flags libvirt.DomainXMLFlags) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if err := d.validateVMRef(); err != nil {
+			return nil, err
+		}
+		xml, err := d.vm.GetXMLDesc(flags)
+		if err != nil {
+			return nil, err
+		}
+		xml, err = redactDomainXML(xml, d.overridesDigest() != "")
+		return []byte(xml), err
+	}
+}
+
+func (d *Driver) diagnosticsDomainState() ([]byte, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, err
+	}
+	virState, reason, err := d.vm.GetState()
+	if err != nil {
+		return nil, err
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return []byte(fmt.Sprintf("libvirt state: %d\nreason: %d\nstate error: %v\n", virState, reason, err)), nil
+	}
+	return []byte(fmt.Sprintf("libvirt state: %d\nreason: %d\nstate: %s\n", virState, reason, s)), nil
+}
+
+func (d *Driver) diagnosticsNetworkXML() ([]byte, error) {
+	if !d.usesLibvirtNetwork() {
+		return nil, fmt.Errorf("machine is not using a libvirt network")
+	}
+	network, err := d.lookupNetwork()
+	if err != nil {
+		return nil, err
+	}
+	defer network.Free() // nolint:errcheck
+	xml, err := network.GetXMLDesc(0)
+	return []byte(xml), err
+}
+
+func (d *Driver) diagnosticsDHCPLeases() ([]byte, error) {
+	if !d.usesLibvirtNetwork() {
+		return nil, fmt.Errorf("machine is not using a libvirt network")
+	}
+	network, err := d.lookupNetwork()
+	if err != nil {
+		return nil, err
+	}
+	defer network.Free() // nolint:errcheck
+	leases, err := network.GetDHCPLeases()
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(leases, "", "  ")
+}
+
+// The diagnostics must not create missing resources, unlike getNetwork and getPool
+func (d *Driver) lookupNetwork() (*libvirt.Network, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.LookupNetworkByName(d.Network)
+}
+
+func (d *Driver) lookupPool() (*libvirt.StoragePool, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.LookupStoragePoolByName(d.getStoragePoolName())
+}
+
+func (d *Driver) diagnosticsPoolXML() ([]byte, error) {
+	pool, err := d.lookupPool()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free() // nolint:errcheck
+	xml, err := pool.GetXMLDesc(0)
+	return []byte(xml), err
+}
+
+func (d *Driver) diagnosticsVolumeXML() ([]byte, error) {
+	pool, err := d.lookupPool()
+	if err != nil {
+		return nil, err
+	}
+	defer pool.Free() // nolint:errcheck
+	vol, err := pool.LookupStorageVolByName(d.getDiskImageFilename())
+	if err != nil {
+		return nil, err
+	}
+	defer vol.Free() // nolint:errcheck
+	xml, err := vol.GetXMLDesc(0)
+	return []byte(xml), err
+}
+
+func (d *Driver) diagnosticsVersions() ([]byte, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	libVersion, err := conn.GetLibVersion()
+	if err != nil {
+		return nil, err
+	}
+	hvVersion, err := conn.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("driver: %s\nlibvirt: %s\nqemu: %s\n",
+		DriverVersion, formatVersion(libVersion), formatVersion(hvVersion))), nil
+}
+
+func (d *Driver) diagnosticsBackingChain() ([]byte, error) {
+	// #nosec G204
+	return exec.Command("qemu-img", "info", "--backing-chain", "-U", d.getDiskImagePath()).CombinedOutput()
+}
+
+func readFile(path string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return ioutil.ReadFile(path) // #nosec G304
+	}
+}
+
+// CollectDiagnostics writes a tar.gz archive to w with everything useful to
+// debug the machine: libvirt definitions and state, versions, console log,
+// disk image backing chain and driver configuration.
+func (d *Driver) CollectDiagnostics(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	bundle := &diagnosticsBundle{
+		tw: tar.NewWriter(gz),
+	}
+	items := []struct {
+		name    string
+		collect func() ([]byte, error)
+	}{
+		{"domain.xml", d.diagnosticsDomainXML(0)},
+		{"domain-inactive.xml", d.diagnosticsDomainXML(libvirt.DOMAIN_XML_INACTIVE)},
+		{"domain-state.txt", d.diagnosticsDomainState},
+		{"network.xml", d.diagnosticsNetworkXML},
+		{"dhcp-leases.json", d.diagnosticsDHCPLeases},
+		{"pool.xml", d.diagnosticsPoolXML},
+		{"volume.xml", d.diagnosticsVolumeXML},
+		{"versions.txt", d.diagnosticsVersions},
+		{"backing-chain.txt", d.diagnosticsBackingChain},
+		{consoleLogFilename, readFile(d.getConsoleLogPath())},
+		{consoleLogFilename + ".1", readFile(d.getConsoleLogPath() + ".1")},
+		{"driver-config.json", func() ([]byte, error) { return redactedConfig(d) }},
+	}
+	for _, item := range items {
+		if err := bundle.add(item.name, item.collect); err != nil {
+			return err
+		}
+	}
+	if err := bundle.tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// CollectDiagnosticsToFile writes the CollectDiagnostics archive to path
+func (d *Driver) CollectDiagnosticsToFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := d.CollectDiagnostics(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatVersion(t *testing.T) {
+	assert.Equal(t, "6.10.0", formatVersion(6010000))
+	assert.Equal(t, "4.5.12", formatVersion(4005012))
+}
+
+func TestRedactedConfig(t *testing.T) {
+	d := newTestDriver()
+	d.GraphicsPassword = "secret"
+	d.IgnitionConfig = `{"passwd": {}}`
+	d.CloudInitUserData = "#cloud-config\n"
+	d.CloudInitMetaData = "instance-id: crc\n"
+	d.CloudInitNetworkConfig = "version: 2\n"
+	d.DomainXMLOverride = "<domain/>"
+	d.DomainPatch = "{}"
+	d.QemuArgs = []string{"-fw_cfg", "name=opt/token,string=abc"}
+	d.KernelCmdline = "console=ttyS0 token=abc"
+
+	data, err := redactedConfig(d)
+	assert.NoError(t, err)
+	var config map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &config))
+	for field := range secretConfigFields {
+		assert.Equal(t, redacted, config[field], field)
+	}
+	assert.Equal(t, "domain", config["MachineName"])
+	assert.Equal(t, "crc", config["Network"])
+
+	// Unset fields are kept as is
+	data, err = redactedConfig(newTestDriver())
+	assert.NoError(t, err)
+	var unset map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &unset))
+	assert.Equal(t, "", unset["GraphicsPassword"])
+	assert.Nil(t, unset["QemuArgs"])
+}
+
+func TestRedactDomainXML(t *testing.T) {
+	d := newTestDriver()
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	redactedXML, err := redactDomainXML(xml, false)
+	assert.NoError(t, err)
+	assert.Equal(t, xml, redactedXML)
+
+	d.Kernel = "vmlinuz"
+	d.KernelCmdline = "console=ttyS0 token=abc"
+	d.QemuArgs = []string{"-fw_cfg", "name=opt/token,string=abc"}
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, "token=abc")
+	redactedXML, err = redactDomainXML(xml, false)
+	assert.NoError(t, err)
+	assert.NotContains(t, redactedXML, "token")
+	assert.Equal(t, 3, strings.Count(redactedXML, "redacted"))
+
+	redactedXML, err = redactDomainXML(xml, true)
+	assert.NoError(t, err)
+	assert.NotContains(t, redactedXML, "<domain")
+}
@@ -0,0 +1,311 @@
+package libvirt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// Wildcard DNS names can't be libvirt network host entries, they are
+// resolved with dnsmasq address=/<domain>/<ip> options instead. dnsmasq only
+// reads its options when the network starts, so the VM address is reserved
+// for its MAC address before it boots, and the network is restarted to apply
+// the options when no other VM uses it.
+
+func dnsmasqAddressPrefix(domain string) string {
+	return "address=/" + domain + "/"
+}
+
+func isDomainAddressOption(option string, domains []string) bool {
+	for _, domain := range domains {
+		if strings.HasPrefix(option, dnsmasqAddressPrefix(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameDnsmasqOptions(a, b []libvirtxml.NetworkDnsmasqOption) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// setDnsmasqAddresses replaces the address options of the wildcard domains
+// with ones resolving to ip, an empty ip only removes them. Other options are
+// kept. It returns false when the network was already up to date.
+func setDnsmasqAddresses(nw *libvirtxml.Network, domains []string, ip string) bool {
+	var current []libvirtxml.NetworkDnsmasqOption
+	if nw.DnsmasqOptions != nil {
+		current = nw.DnsmasqOptions.Option
+	}
+	var options []libvirtxml.NetworkDnsmasqOption
+	for _, option := range current {
+		if !isDomainAddressOption(option.Value, domains) {
+			options = append(options, option)
+		}
+	}
+	if ip != "" {
+		for _, domain := range domains {
+			options = append(options, libvirtxml.NetworkDnsmasqOption{
+				Value: dnsmasqAddressPrefix(domain) + ip,
+			})
+		}
+	}
+	if sameDnsmasqOptions(current, options) {
+		return false
+	}
+	nw.DnsmasqOptions = nil
+	if len(options) != 0 {
+		nw.DnsmasqOptions = &libvirtxml.NetworkDnsmasqOptions{
+			Option: options,
+		}
+	}
+	return true
+}
+
+// dhcpIP returns the IPv4 <ip> element of the network serving DHCP
+func dhcpIP(nw *libvirtxml.Network) *libvirtxml.NetworkIP {
+	for i := range nw.IPs {
+		ip := &nw.IPs[i]
+		if ip.DHCP != nil && len(ip.DHCP.Ranges) != 0 && net.ParseIP(ip.Address).To4() != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// dhcpReservation returns the DHCP host entry of the MAC address
+func dhcpReservation(ip *libvirtxml.NetworkIP, mac string) *libvirtxml.NetworkDHCPHost {
+	for i := range ip.DHCP.Hosts {
+		host := &ip.DHCP.Hosts[i]
+		if strings.EqualFold(host.MAC, mac) {
+			return host
+		}
+	}
+	return nil
+}
+
+// freeDHCPAddress returns the first address of the DHCP range which is not
+// in use
+func freeDHCPAddress(dhcpRange libvirtxml.NetworkDHCPRange, used map[string]bool) (string, error) {
+	start := net.ParseIP(dhcpRange.Start).To4()
+	end := net.ParseIP(dhcpRange.End).To4()
+	if start == nil || end == nil {
+		return "", fmt.Errorf("invalid DHCP range %s-%s", dhcpRange.Start, dhcpRange.End)
+	}
+	last := uint64(binary.BigEndian.Uint32(end))
+	for n := uint64(binary.BigEndian.Uint32(start)); n <= last; n++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(n))
+		if !used[ip.String()] {
+			return ip.String(), nil
+		}
+	}
+	return "", fmt.Errorf("no free address in the DHCP range %s-%s", dhcpRange.Start, dhcpRange.End)
+}
+
+// reserveAddress returns the address reserved for the VM in the network
+// DHCP server, reserving its current lease or a free address if needed
+func (d *Driver) reserveAddress(network *libvirt.Network, nw *libvirtxml.Network) (string, error) {
+	ip := dhcpIP(nw)
+	if ip == nil {
+		return "", fmt.Errorf("network %s has no IPv4 DHCP range", d.Network)
+	}
+	if host := dhcpReservation(ip, macAddress); host != nil && host.IP != "" {
+		return host.IP, nil
+	}
+
+	leases, err := network.GetDHCPLeases()
+	if err != nil {
+		return "", err
+	}
+	address := ""
+	used := map[string]bool{}
+	for _, host := range ip.DHCP.Hosts {
+		used[host.IP] = true
+	}
+	for _, lease := range leases {
+		if strings.EqualFold(lease.Mac, macAddress) && !used[lease.IPaddr] {
+			address = lease.IPaddr
+		}
+		used[lease.IPaddr] = true
+	}
+	if address == "" {
+		if address, err = freeDHCPAddress(ip.DHCP.Ranges[0], used); err != nil {
+			return "", err
+		}
+	}
+
+	host := libvirtxml.NetworkDHCPHost{
+		MAC:  macAddress,
+		Name: d.MachineName,
+		IP:   address,
+	}
+	hostXML, err := host.Marshal()
+	if err != nil {
+		return "", err
+	}
+	log.Debugf("Adding DHCP host entry %s to network %s", hostXML, d.Network)
+	err = network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, networkUpdateFlags(network))
+	if err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+func getNetworkConfig(network *libvirt.Network) (*libvirtxml.Network, error) {
+	xmldoc, err := network.GetXMLDesc(libvirt.NETWORK_XML_INACTIVE)
+	if err != nil {
+		return nil, err
+	}
+	var nw libvirtxml.Network
+	if err := nw.Unmarshal(xmldoc); err != nil {
+		return nil, err
+	}
+	return &nw, nil
+}
+
+// updateNetworkConfig sets the address options in the persistent definition
+// of the network, they are applied when it's started
+func (d *Driver) updateNetworkConfig(network *libvirt.Network, domains []string, ip string) error {
+	config, err := getNetworkConfig(network)
+	if err != nil {
+		return err
+	}
+	if !setDnsmasqAddresses(config, domains, ip) {
+		return nil
+	}
+	xml, err := config.Marshal()
+	if err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Updating the dnsmasq options of network %s", d.Network)
+	updated, err := conn.NetworkDefineXML(xml)
+	if err != nil {
+		return err
+	}
+	return updated.Free()
+}
+
+// networkHasActiveDomains returns true if a running VM is attached to the
+// network, restarting the network would disconnect it
+func (d *Driver) networkHasActiveDomains() (bool, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return false, err
+	}
+	domains, err := conn.ListAllDomains(libvirt.CONNECT_LIST_DOMAINS_ACTIVE)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		for _, domain := range domains {
+			_ = domain.Free()
+		}
+	}()
+	for _, domain := range domains {
+		xml, err := domain.GetXMLDesc(0)
+		if err != nil {
+			return false, err
+		}
+		inUse, err := domainUsesNetwork(xml, d.Network)
+		if err != nil || inUse {
+			return inUse, err
+		}
+	}
+	return false, nil
+}
+
+// setupWildcardDNS makes the network resolve the wildcard DNS names to the
+// VM address, it must run before the VM starts
+func (d *Driver) setupWildcardDNS() error {
+	_, domains := splitDNSHostnames(d.DNSHostnames)
+	if !d.usesLibvirtNetwork() || len(domains) == 0 {
+		return nil
+	}
+	network, err := d.getNetwork()
+	if err != nil {
+		return err
+	}
+	defer network.Free() // nolint:errcheck
+
+	nw, err := getNetworkXML(network)
+	if err != nil {
+		return err
+	}
+	ip, err := d.reserveAddress(network, nw)
+	if err != nil {
+		return err
+	}
+	if err := d.updateNetworkConfig(network, domains, ip); err != nil {
+		return err
+	}
+
+	active, err := network.IsActive()
+	if err != nil {
+		return err
+	}
+	// An inactive network gets the options when it's started
+	if !active || !setDnsmasqAddresses(nw, domains, ip) {
+		return nil
+	}
+	inUse, err := d.networkHasActiveDomains()
+	if err != nil {
+		return err
+	}
+	if inUse {
+		log.Warnf("Network %s is used by other VMs, restart it to resolve the wildcard DNS names: virsh net-destroy %s && virsh net-start %s", d.Network, d.Network, d.Network)
+		return nil
+	}
+	log.Infof("Restarting network %s to apply the wildcard DNS entries", d.Network)
+	if err := network.Destroy(); err != nil {
+		return err
+	}
+	return network.Create()
+}
+
+// removeWildcardDNS drops the address options and the DHCP reservation of
+// the VM. dnsmasq keeps resolving the names until the network restarts.
+func (d *Driver) removeWildcardDNS(network *libvirt.Network) error {
+	_, domains := splitDNSHostnames(d.DNSHostnames)
+	if len(domains) == 0 {
+		return nil
+	}
+	if err := d.updateNetworkConfig(network, domains, ""); err != nil {
+		return err
+	}
+	nw, err := getNetworkXML(network)
+	if err != nil {
+		return err
+	}
+	ip := dhcpIP(nw)
+	if ip == nil {
+		return nil
+	}
+	host := dhcpReservation(ip, macAddress)
+	if host == nil {
+		return nil
+	}
+	hostXML, err := host.Marshal()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Removing DHCP host entry %s from network %s", hostXML, d.Network)
+	return network.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_IP_DHCP_HOST, -1, hostXML, networkUpdateFlags(network))
+}
@@ -0,0 +1,82 @@
+package libvirt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitDNSHostnames(t *testing.T) {
+	hosts, domains := splitDNSHostnames([]string{"api.crc.testing", "*.apps-crc.testing"})
+	assert.Equal(t, []string{"api.crc.testing"}, hosts)
+	assert.Equal(t, []string{"apps-crc.testing"}, domains)
+}
+
+func TestSetDnsmasqAddresses(t *testing.T) {
+	// libvirt uses the dnsmasq namespace prefix
+	nw := &libvirtxml.Network{}
+	assert.NoError(t, nw.Unmarshal(`<network xmlns:dnsmasq="http://libvirt.org/schemas/network/dnsmasq/1.0">
+  <name>crc</name>
+  <dnsmasq:options>
+    <dnsmasq:option value="cache-size=0"/>
+    <dnsmasq:option value="address=/apps-crc.testing/192.168.130.10"/>
+  </dnsmasq:options>
+</network>`))
+	domains := []string{"apps-crc.testing"}
+
+	assert.True(t, setDnsmasqAddresses(nw, domains, "192.168.130.11"))
+	xml, err := nw.Marshal()
+	assert.NoError(t, err)
+	assert.Equal(t, `<network>
+  <name>crc</name>
+  <options xmlns="http://libvirt.org/schemas/network/dnsmasq/1.0">
+    <option value="cache-size=0"></option>
+    <option value="address=/apps-crc.testing/192.168.130.11"></option>
+  </options>
+</network>`, xml)
+	assert.False(t, setDnsmasqAddresses(nw, domains, "192.168.130.11"))
+
+	assert.True(t, setDnsmasqAddresses(nw, domains, ""))
+	assert.Equal(t, []libvirtxml.NetworkDnsmasqOption{{Value: "cache-size=0"}}, nw.DnsmasqOptions.Option)
+
+	nw = &libvirtxml.Network{}
+	assert.False(t, setDnsmasqAddresses(nw, domains, ""))
+	assert.Nil(t, nw.DnsmasqOptions)
+}
+
+func TestDHCPReservation(t *testing.T) {
+	nw := &libvirtxml.Network{
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: "fd00::1",
+				Prefix:  64,
+			},
+			{
+				Address: "192.168.130.1",
+				Prefix:  24,
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{{Start: "192.168.130.2", End: "192.168.130.254"}},
+					Hosts:  []libvirtxml.NetworkDHCPHost{{MAC: "52:FD:FC:07:21:82", IP: "192.168.130.11"}},
+				},
+			},
+		},
+	}
+	ip := dhcpIP(nw)
+	assert.Equal(t, "192.168.130.1", ip.Address)
+	assert.Equal(t, "192.168.130.11", dhcpReservation(ip, macAddress).IP)
+	assert.Nil(t, dhcpReservation(ip, "52:54:00:00:00:01"))
+	assert.Nil(t, dhcpIP(&libvirtxml.Network{}))
+}
+
+func TestFreeDHCPAddress(t *testing.T) {
+	dhcpRange := libvirtxml.NetworkDHCPRange{Start: "192.168.0.254", End: "192.168.1.2"}
+	ip, err := freeDHCPAddress(dhcpRange, map[string]bool{"192.168.0.254": true, "192.168.0.255": true})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.0", ip)
+
+	_, err = freeDHCPAddress(dhcpRange, map[string]bool{"192.168.0.254": true, "192.168.0.255": true, "192.168.1.0": true, "192.168.1.1": true, "192.168.1.2": true})
+	assert.Error(t, err)
+	_, err = freeDHCPAddress(libvirtxml.NetworkDHCPRange{Start: "fd00::2", End: "fd00::ff"}, nil)
+	assert.Error(t, err)
+}
@@ -6,48 +6,68 @@ import (
 
 const macAddress = "52:fd:fc:07:21:82"
 
+func (d *Driver) domainInterface() *libvirtxml.DomainInterface {
+	if !d.hasNetworking() {
+		return nil
+	}
+	iface := &libvirtxml.DomainInterface{
+		MAC: &libvirtxml.DomainInterfaceMAC{
+			Address: macAddress,
+		},
+		Model: &libvirtxml.DomainInterfaceModel{
+			Type: "virtio",
+		},
+	}
+	switch d.getNetworkMode() {
+	case NetworkModeBridge:
+		iface.Source = &libvirtxml.DomainInterfaceSource{
+			Bridge: &libvirtxml.DomainInterfaceSourceBridge{
+				Bridge: d.HostInterface,
+			},
+		}
+	case NetworkModeDirect:
+		iface.Source = &libvirtxml.DomainInterfaceSource{
+			Direct: &libvirtxml.DomainInterfaceSourceDirect{
+				Dev:  d.HostInterface,
+				Mode: "bridge",
+			},
+		}
+	default:
+		iface.Source = &libvirtxml.DomainInterfaceSource{
+			Network: &libvirtxml.DomainInterfaceSourceNetwork{
+				Network: d.Network,
+			},
+		}
+	}
+	return iface
+}
+
 func domainXML(d *Driver, machineType string) (string, error) {
 	domain := libvirtxml.Domain{
-		Type: "kvm",
+		Type: domainType(d),
 		Name: d.MachineName,
 		Memory: &libvirtxml.DomainMemory{
 			Value: uint(d.Memory),
 			Unit:  "MiB",
 		},
+		MemoryBacking: domainMemoryBacking(d),
 		VCPU: &libvirtxml.DomainVCPU{
 			Value: uint(d.CPU),
 		},
-		Features: &libvirtxml.DomainFeatureList{
-			ACPI: &libvirtxml.DomainFeature{},
-			APIC: &libvirtxml.DomainFeatureAPIC{},
-			PAE:  &libvirtxml.DomainFeature{},
-		},
-		CPU: &libvirtxml.DomainCPU{
-			Mode: "host-passthrough",
-			// https://bugzilla.redhat.com/show_bug.cgi?id=1806532
-			Features: []libvirtxml.DomainCPUFeature{
-				{
-					Policy: "disable",
-					Name:   "rdrand",
-				},
-			},
-		},
+		CPUTune:  domainCPUTune(d),
+		NUMATune: domainNUMATune(d),
+		Features: domainFeatures(d),
+		CPU:      domainCPU(d),
 		OS: &libvirtxml.DomainOS{
 			Type: &libvirtxml.DomainOSType{
 				Type: "hvm",
 			},
-			BootDevices: []libvirtxml.DomainBootDevice{
-				{
-					Dev: "hd",
-				},
-			},
+			BootDevices: domainBootDevices(d),
 			BootMenu: &libvirtxml.DomainBootMenu{
 				Enable: "no",
 			},
 		},
-		Clock: &libvirtxml.DomainClock{
-			Offset: "utc",
-		},
+		Clock: domainClock(d),
 		Devices: &libvirtxml.DomainDeviceList{
 			Disks: []libvirtxml.DomainDisk{
 				{
@@ -69,18 +89,7 @@ func domainXML(d *Driver, machineType string) (string, error) {
 					},
 				},
 			},
-			Graphics: []libvirtxml.DomainGraphic{
-				{
-					VNC: &libvirtxml.DomainGraphicVNC{},
-				},
-			},
-			Consoles: []libvirtxml.DomainConsole{
-				{
-					Source: &libvirtxml.DomainChardevSource{
-						StdIO: &libvirtxml.DomainChardevSourceStdIO{},
-					},
-				},
-			},
+			Graphics: domainGraphics(d),
 			RNGs: []libvirtxml.DomainRNG{
 				{
 					Model: "virtio",
@@ -99,30 +108,26 @@ func domainXML(d *Driver, machineType string) (string, error) {
 	if machineType != "" {
 		domain.OS.Type.Machine = machineType
 	}
-	if d.Network != "" {
-		domain.Devices.Interfaces = []libvirtxml.DomainInterface{
-			{
-				MAC: &libvirtxml.DomainInterfaceMAC{
-					Address: macAddress,
-				},
-				Source: &libvirtxml.DomainInterfaceSource{
-					Network: &libvirtxml.DomainInterfaceSourceNetwork{
-						Network: d.Network,
-					},
-				},
-				Model: &libvirtxml.DomainInterfaceModel{
-					Type: "virtio",
-				},
-			},
-		}
+	domainFirmware(d, &domain)
+	domainKernelBoot(d, &domain)
+	domain.SysInfo = domainIgnition(d)
+	domainCDROMs(d, &domain)
+	domain.Devices.Serials, domain.Devices.Consoles = domainSerialConsole(d)
+	if iface := d.domainInterface(); iface != nil {
+		domain.Devices.Interfaces = []libvirtxml.DomainInterface{*iface}
 	}
 	if d.VSock {
-		domain.Devices.VSock = &libvirtxml.DomainVSock{
-			Model: "virtio",
-			CID: &libvirtxml.DomainVSockCID{
-				Auto: "yes",
-			},
-		}
+		domain.Devices.VSock = domainVSock(d)
+	}
+	if d.GuestAgent {
+		domain.Devices.Channels = []libvirtxml.DomainChannel{guestAgentChannelXML()}
+	}
+	if d.TPM {
+		domain.Devices.TPMs = []libvirtxml.DomainTPM{domainTPM(d.getArch())}
+	}
+	if err := applyDomainOverrides(d, &domain); err != nil {
+		return "", err
 	}
+	domainOverridesMetadata(d, &domain)
 	return domain.Marshal()
 }
@@ -8,6 +8,26 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+func newTestDriver() *Driver {
+	return &Driver{
+		Driver: &libvirt.Driver{
+			VMDriver: &drivers.VMDriver{
+				BaseDriver: &drivers.BaseDriver{
+					MachineName: "domain",
+				},
+				ImageSourcePath: "disk_path",
+				ImageFormat:     "test",
+				Memory:          4096,
+				CPU:             4,
+			},
+			Network:   "crc",
+			CacheMode: "default",
+			IOMode:    "threads",
+		},
+		arch: ArchX86_64,
+	}
+}
+
 func TestTemplating(t *testing.T) {
 	xml, err := domainXML(&Driver{
 		Driver: &libvirt.Driver{
@@ -25,6 +45,7 @@ func TestTemplating(t *testing.T) {
 			IOMode:    "threads",
 			VSock:     false,
 		},
+		arch: ArchX86_64,
 	}, "q35")
 
 	assert.NoError(t, err)
@@ -45,7 +66,12 @@ func TestTemplating(t *testing.T) {
   <cpu mode="host-passthrough">
     <feature policy="disable" name="rdrand"></feature>
   </cpu>
-  <clock offset="utc"></clock>
+  <clock offset="utc">
+    <timer name="rtc" tickpolicy="catchup"></timer>
+    <timer name="pit" tickpolicy="delay"></timer>
+    <timer name="hpet" present="no"></timer>
+    <timer name="kvmclock" present="yes"></timer>
+  </clock>
   <devices>
     <disk type="file" device="disk">
       <driver name="qemu" type="qcow2" cache="default" io="threads"></driver>
@@ -57,7 +83,13 @@ func TestTemplating(t *testing.T) {
       <source network="network"></source>
       <model type="virtio"></model>
     </interface>
-    <console type="stdio"></console>
+    <serial type="pty">
+      <target port="0"></target>
+      <log file="machines/domain/console.log" append="off"></log>
+    </serial>
+    <console type="pty">
+      <target type="serial" port="0"></target>
+    </console>
     <graphics type="vnc"></graphics>
     <memballoon model="none"></memballoon>
     <rng model="virtio">
@@ -115,3 +147,53 @@ func TestNetworkTemplating(t *testing.T) {
       <model type="virtio"></model>
     </interface>`)
 }
+
+func TestBridgeNetworkTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.NetworkMode = NetworkModeBridge
+	d.HostInterface = "br0"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="bridge">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source bridge="br0"></source>
+      <model type="virtio"></model>
+    </interface>`)
+}
+
+func TestDirectNetworkTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.NetworkMode = NetworkModeDirect
+	d.HostInterface = "eth0"
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<interface type="direct">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source dev="eth0" mode="bridge"></source>
+      <model type="virtio"></model>
+    </interface>`)
+}
+
+func TestVSockCIDTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.VSock = true
+	d.VSockCID = 42
+	xml, err := domainXML(d, "")
+	assert.NoError(t, err)
+	assert.Regexp(t, `(?s)<devices>(.*?)<vsock model="virtio">\s*<cid auto="no" address="42">\s*</cid>\s*</vsock>(.*?)</devices>`, xml)
+
+	cid, err := vsockCIDFromXML(xml)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(42), cid)
+}
+
+func TestCheckVSock(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkVSock())
+	d.VSockCID = 3
+	assert.NoError(t, d.checkVSock())
+	d.VSockCID = 2
+	assert.Error(t, d.checkVSock())
+	d.VSockCID = 0xffffffff
+	assert.Error(t, d.checkVSock())
+}
@@ -0,0 +1,363 @@
+package libvirt
+
+import (
+	"reflect"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// DomainDrift is a difference between the definition of an existing VM and
+// the one the driver would generate for it
+type DomainDrift struct {
+	// Part of the definition which differs
+	Name string
+	// Safe drift is fixed on Start, other drift needs the VM to be recreated
+	Safe bool
+}
+
+// driftCheck compares one part of the definitions. apply updates current to
+// match desired, it's only set for safe drift.
+type driftCheck struct {
+	name    string
+	differs func(current, desired *libvirtxml.Domain) bool
+	apply   func(current, desired *libvirtxml.Domain)
+}
+
+func hasGuestAgentChannel(domain *libvirtxml.Domain) bool {
+	for _, channel := range domain.Devices.Channels {
+		if channel.Target != nil && channel.Target.VirtIO != nil && channel.Target.VirtIO.Name == guestAgentChannel {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSerialLog(domain *libvirtxml.Domain) bool {
+	return len(domain.Devices.Serials) != 0 && domain.Devices.Serials[0].Log != nil
+}
+
+func graphicsTypes(domain *libvirtxml.Domain) []string {
+	var types []string
+	for _, graphic := range domain.Devices.Graphics {
+		switch {
+		case graphic.VNC != nil:
+			types = append(types, GraphicsVNC)
+		case graphic.Spice != nil:
+			types = append(types, GraphicsSpice)
+		default:
+			types = append(types, "other")
+		}
+	}
+	return types
+}
+
+func usesUEFI(domain *libvirtxml.Domain) bool {
+	return domain.OS.Firmware == FirmwareEFI || (domain.OS.Loader != nil && domain.OS.Loader.Path != "")
+}
+
+func interfaceSources(domain *libvirtxml.Domain) []libvirtxml.DomainInterfaceSource {
+	var sources []libvirtxml.DomainInterfaceSource
+	for _, iface := range domain.Devices.Interfaces {
+		if iface.Source != nil {
+			sources = append(sources, *iface.Source)
+		}
+	}
+	return sources
+}
+
+func cpuMode(domain *libvirtxml.Domain) libvirtxml.DomainCPU {
+	if domain.CPU == nil {
+		return libvirtxml.DomainCPU{}
+	}
+	cpu := libvirtxml.DomainCPU{
+		Mode:  domain.CPU.Mode,
+		Model: domain.CPU.Model,
+	}
+	if cpu.Model != nil && cpu.Model.Fallback == "" {
+		// libvirt adds the default fallback value
+		cpu.Model = &libvirtxml.DomainCPUModel{
+			Value:    cpu.Model.Value,
+			Fallback: "allow",
+		}
+	}
+	return cpu
+}
+
+// The driver disables rdrand on some hosts, see needsRdrandWorkaround
+func isRdrandWorkaround(feature libvirtxml.DomainCPUFeature) bool {
+	return feature.Name == "rdrand" && feature.Policy == "disable"
+}
+
+func hasRdrandWorkaround(domain *libvirtxml.Domain) bool {
+	if domain.CPU == nil {
+		return false
+	}
+	for _, feature := range domain.CPU.Features {
+		if isRdrandWorkaround(feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// cpuFeatures returns the user configured CPU features
+func cpuFeatures(domain *libvirtxml.Domain) []libvirtxml.DomainCPUFeature {
+	if domain.CPU == nil {
+		return nil
+	}
+	var features []libvirtxml.DomainCPUFeature
+	for _, feature := range domain.CPU.Features {
+		if !isRdrandWorkaround(feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// driftChecks returns the parts of the definition the driver manages. The
+// identity of the VM (UUID, MAC address, disk image) is never changed as
+// the comparison is only done on these parts.
+func driftChecks() []driftCheck {
+	return []driftCheck{
+		{
+			name: "vsock",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return (current.Devices.VSock == nil) != (desired.Devices.VSock == nil)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.Devices.VSock = desired.Devices.VSock
+			},
+		},
+		{
+			name: "rng",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return len(current.Devices.RNGs) != len(desired.Devices.RNGs)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.Devices.RNGs = desired.Devices.RNGs
+			},
+		},
+		{
+			name: "guest agent channel",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return hasGuestAgentChannel(current) != hasGuestAgentChannel(desired)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				var channels []libvirtxml.DomainChannel
+				for _, channel := range current.Devices.Channels {
+					if channel.Target == nil || channel.Target.VirtIO == nil || channel.Target.VirtIO.Name != guestAgentChannel {
+						channels = append(channels, channel)
+					}
+				}
+				if hasGuestAgentChannel(desired) {
+					channels = append(channels, guestAgentChannelXML())
+				}
+				current.Devices.Channels = channels
+			},
+		},
+		{
+			name: "serial console",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return hasSerialLog(current) != hasSerialLog(desired)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.Devices.Serials = desired.Devices.Serials
+				current.Devices.Consoles = desired.Devices.Consoles
+			},
+		},
+		{
+			name: "clock",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(current.Clock, desired.Clock)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.Clock = desired.Clock
+			},
+		},
+		{
+			name: "graphics",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(graphicsTypes(current), graphicsTypes(desired))
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.Devices.Graphics = desired.Devices.Graphics
+			},
+		},
+		{
+			name: "qemu arguments",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(current.QEMUCommandline, desired.QEMUCommandline)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				current.QEMUCommandline = desired.QEMUCommandline
+			},
+		},
+		{
+			// Older versions applied the workaround on all the hosts
+			name: "rdrand workaround",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return current.CPU != nil && hasRdrandWorkaround(current) != hasRdrandWorkaround(desired)
+			},
+			apply: func(current, desired *libvirtxml.Domain) {
+				var features []libvirtxml.DomainCPUFeature
+				if hasRdrandWorkaround(desired) {
+					features = append(features, libvirtxml.DomainCPUFeature{
+						Policy: "disable",
+						Name:   "rdrand",
+					})
+				}
+				current.CPU.Features = append(features, cpuFeatures(current)...)
+			},
+		},
+		// Unsafe drift, the guest may not boot, or may lose its IP
+		// address or its TPM secrets after these changes
+		{
+			name: "firmware",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return usesUEFI(current) != usesUEFI(desired)
+			},
+		},
+		{
+			name: "tpm",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return len(current.Devices.TPMs) != len(desired.Devices.TPMs)
+			},
+		},
+		{
+			name: "network interface",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(interfaceSources(current), interfaceSources(desired))
+			},
+		},
+		{
+			name: "cpu model",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(cpuMode(current), cpuMode(desired))
+			},
+		},
+		{
+			name: "cpu features",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return !reflect.DeepEqual(cpuFeatures(current), cpuFeatures(desired))
+			},
+		},
+		{
+			// The overrides may change any part of the definition
+			name: "domain overrides",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return metadataOverridesDigest(current) != metadataOverridesDigest(desired)
+			},
+		},
+		{
+			name: "domain type",
+			differs: func(current, desired *libvirtxml.Domain) bool {
+				return current.Type != desired.Type
+			},
+		},
+	}
+}
+
+// diffDomains compares the definitions, and updates current with the safe
+// changes
+func diffDomains(current, desired *libvirtxml.Domain) []DomainDrift {
+	if current.Devices == nil {
+		current.Devices = &libvirtxml.DomainDeviceList{}
+	}
+	if current.OS == nil {
+		current.OS = &libvirtxml.DomainOS{}
+	}
+	var drift []DomainDrift
+	for _, check := range driftChecks() {
+		if !check.differs(current, desired) {
+			continue
+		}
+		drift = append(drift, DomainDrift{
+			Name: check.name,
+			Safe: check.apply != nil,
+		})
+		if check.apply != nil {
+			check.apply(current, desired)
+		}
+	}
+	return drift
+}
+
+// domainDrift returns the VM definitions, as currently defined in libvirt
+// and as generated by this driver version
+func (d *Driver) domainDrift() (*libvirtxml.Domain, []DomainDrift, error) {
+	if err := d.validateVMRef(); err != nil {
+		return nil, nil, err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	machineType, err := d.resolveHostConfig(conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	currentXML, err := d.vm.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := &libvirtxml.Domain{}
+	if err := current.Unmarshal(currentXML); err != nil {
+		return nil, nil, err
+	}
+	desiredXML, err := domainXML(d, machineType)
+	if err != nil {
+		return nil, nil, err
+	}
+	desired := &libvirtxml.Domain{}
+	if err := desired.Unmarshal(desiredXML); err != nil {
+		return nil, nil, err
+	}
+	return current, diffDomains(current, desired), nil
+}
+
+// GetDomainDrift returns the differences between the VM definition and the
+// one this driver version generates
+func (d *Driver) GetDomainDrift() ([]DomainDrift, error) {
+	_, drift, err := d.domainDrift()
+	return drift, err
+}
+
+// reconcileDomain redefines the VM with the safe changes, and reports the
+// other ones
+func (d *Driver) reconcileDomain() error {
+	updated, drift, err := d.domainDrift()
+	if err != nil {
+		return err
+	}
+	safe := false
+	for _, change := range drift {
+		if change.Safe {
+			log.Debugf("Updating the %s of VM %s", change.Name, d.MachineName)
+			safe = true
+			continue
+		}
+		log.Warnf("The %s of VM %s doesn't match its configuration, delete and recreate the VM to update it", change.Name, d.MachineName)
+	}
+	if !safe {
+		return nil
+	}
+	xml, err := updated.Marshal()
+	if err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	vm, err := conn.DomainDefineXMLFlags(xml, libvirt.DOMAIN_DEFINE_VALIDATE)
+	if err != nil {
+		return err
+	}
+	if err := d.vm.Free(); err != nil {
+		log.Debugf("Failed to free the previous domain reference: %v", err)
+	}
+	d.vm = vm
+	return nil
+}
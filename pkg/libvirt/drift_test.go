@@ -0,0 +1,149 @@
+package libvirt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func unmarshalTestDomain(t *testing.T, d *Driver) *libvirtxml.Domain {
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	domain := &libvirtxml.Domain{}
+	assert.NoError(t, domain.Unmarshal(xml))
+	return domain
+}
+
+func TestDiffDomains(t *testing.T) {
+	d := newTestDriver()
+	current := unmarshalTestDomain(t, d)
+	current.UUID = "c7a5fdbd-cdaf-9455-926a-d65c16db1809"
+	current.Devices.Serials = nil
+	current.Devices.Consoles = nil
+	current.Devices.RNGs = nil
+
+	d.VSock = true
+	d.GuestAgent = true
+	desired := unmarshalTestDomain(t, d)
+
+	drift := diffDomains(current, desired)
+	assert.Equal(t, []DomainDrift{
+		{Name: "vsock", Safe: true},
+		{Name: "rng", Safe: true},
+		{Name: "guest agent channel", Safe: true},
+		{Name: "serial console", Safe: true},
+	}, drift)
+
+	assert.Equal(t, "c7a5fdbd-cdaf-9455-926a-d65c16db1809", current.UUID)
+	assert.NotNil(t, current.Devices.VSock)
+	assert.Len(t, current.Devices.RNGs, 1)
+	assert.True(t, hasGuestAgentChannel(current))
+	assert.True(t, hasSerialLog(current))
+	assert.Empty(t, diffDomains(current, desired))
+}
+
+func TestDiffDomainsUnsafe(t *testing.T) {
+	d := newTestDriver()
+	current := unmarshalTestDomain(t, d)
+
+	d.Network = "other"
+	d.Firmware = FirmwareEFI
+	desired := unmarshalTestDomain(t, d)
+
+	drift := diffDomains(current, desired)
+	assert.Equal(t, []DomainDrift{
+		{Name: "firmware", Safe: false},
+		{Name: "network interface", Safe: false},
+	}, drift)
+	assert.Equal(t, "crc", current.Devices.Interfaces[0].Source.Network.Network)
+	assert.Nil(t, current.OS.Loader)
+}
+
+func TestDiffDomainsCPUFeaturesAndOverrides(t *testing.T) {
+	d := newTestDriver()
+	current := unmarshalTestDomain(t, d)
+
+	d.CPUFeatures = []CPUFeature{{Name: "vmx", Policy: "require"}}
+	d.DomainPatch = `{"OnCrash": "preserve"}`
+	desired := unmarshalTestDomain(t, d)
+
+	drift := diffDomains(current, desired)
+	assert.Equal(t, []DomainDrift{
+		{Name: "cpu features", Safe: false},
+		{Name: "domain overrides", Safe: false},
+	}, drift)
+	assert.Equal(t, d.overridesDigest(), metadataOverridesDigest(desired))
+	assert.Empty(t, diffDomains(desired, unmarshalTestDomain(t, d)))
+
+	// libvirt may use another namespace prefix
+	desired.Metadata.XML = `<crc:overrides xmlns:crc="https://github.com/code-ready/machine-driver-libvirt" digest="abc"></crc:overrides>`
+	assert.Equal(t, "abc", metadataOverridesDigest(desired))
+}
+
+// Definition generated by the driver before the drift checks were added
+const legacyDomainXML = `<domain type="kvm">
+  <name>domain</name>
+  <memory unit="MiB">4096</memory>
+  <vcpu>4</vcpu>
+  <os>
+    <type machine="q35">hvm</type>
+    <boot dev="hd"></boot>
+    <bootmenu enable="no"></bootmenu>
+  </os>
+  <features>
+    <pae></pae>
+    <acpi></acpi>
+    <apic></apic>
+  </features>
+  <cpu mode="host-passthrough">
+    <feature policy="disable" name="rdrand"></feature>
+  </cpu>
+  <clock offset="utc"></clock>
+  <devices>
+    <disk type="file" device="disk">
+      <driver name="qemu" type="qcow2" cache="default" io="threads"></driver>
+      <source file="machines/domain/domain.test"></source>
+      <target dev="vda" bus="virtio"></target>
+    </disk>
+    <interface type="network">
+      <mac address="52:fd:fc:07:21:82"></mac>
+      <source network="crc"></source>
+      <model type="virtio"></model>
+    </interface>
+    <console type="stdio"></console>
+    <graphics type="vnc"></graphics>
+    <memballoon model="none"></memballoon>
+    <rng model="virtio">
+      <backend model="random">/dev/urandom</backend>
+    </rng>
+  </devices>
+</domain>`
+
+func TestDiffLegacyDomain(t *testing.T) {
+	current := &libvirtxml.Domain{}
+	assert.NoError(t, current.Unmarshal(legacyDomainXML))
+
+	// Not an AMD host, the rdrand workaround is dropped
+	d := newTestDriver()
+	d.hostCPU = &libvirtxml.CapsHostCPU{Vendor: "Intel"}
+	assert.False(t, d.needsRdrandWorkaround())
+	desired := unmarshalTestDomain(t, d)
+
+	drift := diffDomains(current, desired)
+	assert.Contains(t, drift, DomainDrift{Name: "rdrand workaround", Safe: true})
+	for _, change := range drift {
+		assert.True(t, change.Safe, change.Name)
+	}
+	assert.False(t, hasRdrandWorkaround(current))
+	assert.Empty(t, diffDomains(current, desired))
+
+	// User configured features are kept after the workaround
+	current = &libvirtxml.Domain{}
+	assert.NoError(t, current.Unmarshal(legacyDomainXML))
+	current.CPU.Features = append(current.CPU.Features, libvirtxml.DomainCPUFeature{Policy: "require", Name: "vmx"})
+	d.CPUFeatures = []CPUFeature{{Name: "vmx", Policy: "require"}}
+	desired = unmarshalTestDomain(t, d)
+	assert.NotContains(t, diffDomains(current, desired), DomainDrift{Name: "cpu features", Safe: false})
+	assert.Equal(t, []libvirtxml.DomainCPUFeature{{Policy: "require", Name: "vmx"}}, current.CPU.Features)
+}
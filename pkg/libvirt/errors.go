@@ -0,0 +1,96 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+var (
+	ErrConnectionFailed    = errors.New("unable to connect to libvirt, is libvirtd running and are you a member of the libvirt group?")
+	ErrNetworkNotFound     = errors.New("libvirt network not found")
+	ErrNetworkCreation     = errors.New("failed to create libvirt network")
+	ErrStoragePoolNotFound = errors.New("libvirt storage pool not found")
+	ErrStoragePoolCreation = errors.New("failed to create libvirt storage pool")
+	ErrMachineNotFound     = errors.New("machine not found")
+	ErrHostCheckFailed     = errors.New("host check failed")
+)
+
+// Error is returned when a libvirt operation fails. Kind is one of the
+// ErrXXX sentinel errors, and can be checked with errors.Is. The libvirt
+// error, when available, can be retrieved with errors.As.
+type Error struct {
+	Kind error
+	// Name of the libvirt object the operation was about
+	Name string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	msg := e.Kind.Error()
+	if e.Name != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Name)
+	}
+	var virErr libvirt.Error
+	if errors.As(e.Err, &virErr) {
+		return fmt.Sprintf("%s (%s)", msg, virErr.Message)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%s (%v)", msg, e.Err)
+	}
+	return msg
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// LibvirtError returns the libvirt error code, domain and message, if the
+// failure comes from libvirt
+func (e *Error) LibvirtError() (libvirt.Error, bool) {
+	var virErr libvirt.Error
+	ok := errors.As(e.Err, &virErr)
+	return virErr, ok
+}
+
+// CheckError is returned by PreCreateCheck when the host cannot run the
+// machine. It matches ErrHostCheckFailed with errors.Is.
+type CheckError struct {
+	// Name of the failed check
+	Check  string
+	Reason string
+	// What the user can do to fix the failure
+	Hint string
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("%s. %s", e.Reason, e.Hint)
+}
+
+func (e *CheckError) Is(target error) bool {
+	return target == ErrHostCheckFailed
+}
+
+// newError wraps err with kind, unless it's already an *Error
+func newError(kind error, name string, err error) error {
+	var driverErr *Error
+	if errors.As(err, &driverErr) {
+		return err
+	}
+	return &Error{
+		Kind: kind,
+		Name: name,
+		Err:  err,
+	}
+}
+
+// isLibvirtErrorCode returns true if err comes from libvirt with this code
+func isLibvirtErrorCode(err error, code libvirt.ErrorNumber) bool {
+	var virErr libvirt.Error
+	return errors.As(err, &virErr) && virErr.Code == code
+}
@@ -0,0 +1,51 @@
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestError(t *testing.T) {
+	virErr := libvirt.Error{
+		Code:    libvirt.ERR_NO_NETWORK,
+		Domain:  libvirt.FROM_NETWORK,
+		Message: "Network not found: no network with matching name 'crc'",
+	}
+	err := fmt.Errorf("validating network: %w", newError(ErrNetworkNotFound, "crc", virErr))
+
+	assert.True(t, errors.Is(err, ErrNetworkNotFound))
+	assert.False(t, errors.Is(err, ErrStoragePoolNotFound))
+	assert.Equal(t, "validating network: libvirt network not found: crc (Network not found: no network with matching name 'crc')", err.Error())
+
+	var driverErr *Error
+	assert.True(t, errors.As(err, &driverErr))
+	assert.Equal(t, "crc", driverErr.Name)
+
+	var libvirtErr libvirt.Error
+	assert.True(t, errors.As(err, &libvirtErr))
+	assert.Equal(t, libvirt.ERR_NO_NETWORK, libvirtErr.Code)
+	assert.Equal(t, libvirt.FROM_NETWORK, libvirtErr.Domain)
+}
+
+func TestNewErrorDoesNotRewrap(t *testing.T) {
+	err := newError(ErrStoragePoolCreation, "crc", errors.New("permission denied"))
+	assert.Equal(t, err, newError(ErrStoragePoolNotFound, "crc", err))
+	assert.True(t, errors.Is(err, ErrStoragePoolCreation))
+}
+
+func TestIsLibvirtErrorCode(t *testing.T) {
+	notFound := libvirt.Error{Code: libvirt.ERR_NO_NETWORK}
+	assert.True(t, isLibvirtErrorCode(notFound, libvirt.ERR_NO_NETWORK))
+	assert.True(t, isLibvirtErrorCode(fmt.Errorf("lookup: %w", notFound), libvirt.ERR_NO_NETWORK))
+	assert.False(t, isLibvirtErrorCode(libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR}, libvirt.ERR_NO_NETWORK))
+	assert.False(t, isLibvirtErrorCode(errors.New("no network"), libvirt.ERR_NO_NETWORK))
+
+	// Creation failures are not reported as a missing network
+	err := newError(ErrNetworkCreation, "crc", libvirt.Error{Code: libvirt.ERR_INTERNAL_ERROR})
+	assert.True(t, errors.Is(err, ErrNetworkCreation))
+	assert.False(t, errors.Is(err, ErrNetworkNotFound))
+}
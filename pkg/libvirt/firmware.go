@@ -0,0 +1,112 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
+const nvramFilename = "nvram.fd"
+
+// usesEFI returns true for UEFI boot, the only option on aarch64
+func (d *Driver) usesEFI() bool {
+	return d.Firmware == FirmwareEFI || d.FirmwareLoader != "" || d.getArch() == ArchAArch64
+}
+
+// getNVRAMPath returns the path of the per-machine UEFI variable store
+func (d *Driver) getNVRAMPath() string {
+	return d.ResolveStorePath(nvramFilename)
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// domainFirmware sets up UEFI boot in the domain OS element. Without an
+// explicit loader, libvirt picks an OVMF build matching the secure boot
+// setting from the firmware descriptors installed on the host.
+func domainFirmware(d *Driver, domain *libvirtxml.Domain) {
+	if !d.usesEFI() {
+		return
+	}
+	if d.FirmwareLoader == "" {
+		domain.OS.Firmware = FirmwareEFI
+		domain.OS.Loader = &libvirtxml.DomainLoader{
+			Secure: yesNo(d.SecureBoot),
+		}
+	} else {
+		domain.OS.Loader = &libvirtxml.DomainLoader{
+			Path:     d.FirmwareLoader,
+			Readonly: "yes",
+			Secure:   yesNo(d.SecureBoot),
+			Type:     "pflash",
+		}
+	}
+	domain.OS.NVRam = &libvirtxml.DomainNVRam{
+		NVRam:    d.getNVRAMPath(),
+		Template: d.FirmwareNVRAMTemplate,
+	}
+	if d.SecureBoot && d.isX86() {
+		// The secure boot OVMF builds protect their variables with SMM
+		domain.Features.SMM = &libvirtxml.DomainFeatureSMM{
+			State: "on",
+		}
+	}
+}
+
+func checkFirmwareFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return &CheckError{
+			Check:  "firmware",
+			Reason: fmt.Sprintf("firmware file %s is not accessible: %v", path, err),
+			Hint:   "Install the edk2-ovmf package or fix the firmware paths",
+		}
+	}
+	return nil
+}
+
+func (d *Driver) checkFirmware(machineType string) error {
+	switch d.Firmware {
+	case "", FirmwareBIOS:
+		if d.FirmwareLoader == "" && d.SecureBoot {
+			return &CheckError{
+				Check:  "firmware",
+				Reason: "secure boot requires UEFI firmware",
+				Hint:   "Set the firmware to efi",
+			}
+		}
+		if d.FirmwareLoader == "" {
+			return nil
+		}
+	case FirmwareEFI:
+	default:
+		return &CheckError{
+			Check:  "firmware",
+			Reason: fmt.Sprintf("unsupported firmware '%s'", d.Firmware),
+			Hint:   "Use bios or efi",
+		}
+	}
+	if d.SecureBoot && d.isX86() && machineType != "q35" {
+		return &CheckError{
+			Check:  "firmware",
+			Reason: "secure boot requires the q35 machine type",
+			Hint:   "Disable secure boot, or update qemu",
+		}
+	}
+	if err := checkFirmwareFile(d.FirmwareLoader); err != nil {
+		return err
+	}
+	return checkFirmwareFile(d.FirmwareNVRAMTemplate)
+}
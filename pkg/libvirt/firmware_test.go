@@ -0,0 +1,54 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirmwareAutoselectTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.Firmware = FirmwareEFI
+	d.SecureBoot = true
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<os firmware="efi">`)
+	assert.Contains(t, xml, `<loader secure="yes"></loader>
+    <nvram>/store/machines/domain/nvram.fd</nvram>`)
+	assert.Contains(t, xml, `<smm state="on"></smm>`)
+}
+
+func TestFirmwareLoaderTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.FirmwareLoader = "/usr/share/OVMF/OVMF_CODE.fd"
+	d.FirmwareNVRAMTemplate = "/usr/share/OVMF/OVMF_VARS.fd"
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<loader readonly="yes" secure="no" type="pflash">/usr/share/OVMF/OVMF_CODE.fd</loader>
+    <nvram template="/usr/share/OVMF/OVMF_VARS.fd">/store/machines/domain/nvram.fd</nvram>`)
+	assert.NotContains(t, xml, `firmware=`)
+	assert.NotContains(t, xml, `<smm`)
+}
+
+func TestCheckFirmware(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkFirmware(""))
+
+	d.SecureBoot = true
+	assert.Error(t, d.checkFirmware("q35"))
+
+	d.Firmware = FirmwareEFI
+	assert.NoError(t, d.checkFirmware("q35"))
+	assert.Error(t, d.checkFirmware(""))
+
+	d.Firmware = "coreboot"
+	assert.Error(t, d.checkFirmware("q35"))
+
+	d.Firmware = ""
+	d.FirmwareLoader = "/nonexistent/OVMF_CODE.fd"
+	assert.Error(t, d.checkFirmware("q35"))
+}
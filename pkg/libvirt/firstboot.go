@@ -0,0 +1,188 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ignitionFilename = "ignition.json"
+	// fw_cfg key read by Ignition on QEMU
+	ignitionFWCfgKey = "opt/com.coreos/config"
+
+	cloudInitSeedFilename = "cloud-init-seed.iso"
+	// Volume label of a cloud-init NoCloud datasource
+	cloudInitVolumeLabel = "cidata"
+)
+
+// mkisofs compatible tools, in order of preference
+var isoTools = []string{"genisoimage", "mkisofs", "xorrisofs"}
+
+// Accounts running qemu for qemu:///system, depending on the distribution
+var qemuUsers = []string{"qemu", "libvirt-qemu"}
+
+func (d *Driver) getIgnitionPath() string {
+	return d.ResolveStorePath(ignitionFilename)
+}
+
+func (d *Driver) getCloudInitSeedPath() string {
+	return d.ResolveStorePath(cloudInitSeedFilename)
+}
+
+func (d *Driver) usesCloudInit() bool {
+	return d.CloudInitUserData != ""
+}
+
+// domainIgnition passes the Ignition config to the guest firmware config
+func domainIgnition(d *Driver) []libvirtxml.DomainSysInfo {
+	if d.IgnitionConfig == "" {
+		return nil
+	}
+	return []libvirtxml.DomainSysInfo{
+		{
+			FWCfg: &libvirtxml.DomainSysInfoFWCfg{
+				Entry: []libvirtxml.DomainSysInfoEntry{
+					{
+						Name: ignitionFWCfgKey,
+						File: d.getIgnitionPath(),
+					},
+				},
+			},
+		},
+	}
+}
+
+func findISOTool() (string, error) {
+	for _, tool := range isoTools {
+		if path, err := exec.LookPath(tool); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("none of %v found in $PATH", isoTools)
+}
+
+func (d *Driver) cloudInitMetaData() string {
+	if d.CloudInitMetaData != "" {
+		return d.CloudInitMetaData
+	}
+	return fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", d.MachineName, d.MachineName)
+}
+
+func (d *Driver) createCloudInitSeed() error {
+	tool, err := findISOTool()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "cidata")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	files := map[string]string{
+		"user-data": d.CloudInitUserData,
+		"meta-data": d.cloudInitMetaData(),
+	}
+	if d.CloudInitNetworkConfig != "" {
+		files["network-config"] = d.CloudInitNetworkConfig
+	}
+	args := []string{"-output", d.getCloudInitSeedPath(), "-volid", cloudInitVolumeLabel, "-joliet", "-rock"}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			return err
+		}
+		args = append(args, path)
+	}
+	// #nosec G204
+	if out, err := exec.Command(tool, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("Failed to create the cloud-init seed image: %v: %s", err, out)
+	}
+	return nil
+}
+
+// grantQemuAccess gives the qemu service account read access to a file
+// through an ACL. When that's not possible, libvirt still gives qemu access
+// to the file when it starts the VM if its dynamic_ownership is enabled.
+func grantQemuAccess(path string) {
+	setfacl, err := exec.LookPath("setfacl")
+	if err != nil {
+		log.Debugf("setfacl was not found, relying on libvirt to give qemu access to %s", path)
+		return
+	}
+	for _, name := range qemuUsers {
+		if _, err := user.Lookup(name); err != nil {
+			continue
+		}
+		// #nosec G204
+		if out, err := exec.Command(setfacl, "-m", fmt.Sprintf("u:%s:r", name), path).CombinedOutput(); err != nil {
+			log.Warnf("Failed to give %s access to %s: %v: %s", name, path, err, out)
+		}
+		return
+	}
+	log.Debugf("No qemu account found, relying on libvirt to give qemu access to %s", path)
+}
+
+// setupFirstBootConfig writes the Ignition config and the cloud-init seed
+// image to the machine directory. They may contain secrets, so they are only
+// readable by the current user and the qemu service account.
+func (d *Driver) setupFirstBootConfig() error {
+	if d.IgnitionConfig != "" {
+		log.Debugf("Writing Ignition config to %s", d.getIgnitionPath())
+		if err := ioutil.WriteFile(d.getIgnitionPath(), []byte(d.IgnitionConfig), 0600); err != nil {
+			return err
+		}
+		// WriteFile doesn't change the mode of an existing file
+		if err := os.Chmod(d.getIgnitionPath(), 0600); err != nil {
+			return err
+		}
+		grantQemuAccess(d.getIgnitionPath())
+	}
+	if d.usesCloudInit() {
+		log.Debugf("Creating cloud-init seed image %s", d.getCloudInitSeedPath())
+		if err := d.createCloudInitSeed(); err != nil {
+			return err
+		}
+		// The ISO tools create the image with the umask permissions
+		if err := os.Chmod(d.getCloudInitSeedPath(), 0600); err != nil {
+			return err
+		}
+		grantQemuAccess(d.getCloudInitSeedPath())
+	}
+	return nil
+}
+
+func (d *Driver) checkFirstBootConfig() error {
+	if d.IgnitionConfig != "" && !json.Valid([]byte(d.IgnitionConfig)) {
+		return &CheckError{
+			Check:  "ignition",
+			Reason: "the Ignition config is not valid JSON",
+			Hint:   "Fix the Ignition config",
+		}
+	}
+	if d.IgnitionConfig != "" && d.usesCloudInit() {
+		return &CheckError{
+			Check:  "first-boot-config",
+			Reason: "both an Ignition config and cloud-init user data are set",
+			Hint:   "Use the one supported by the guest image",
+		}
+	}
+	if d.usesCloudInit() {
+		if _, err := findISOTool(); err != nil {
+			return &CheckError{
+				Check:  "cloud-init",
+				Reason: fmt.Sprintf("the cloud-init seed image cannot be created: %v", err),
+				Hint:   "Install the genisoimage or xorriso package",
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package libvirt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnitionTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.IgnitionConfig = `{"ignition": {"version": "3.1.0"}}`
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<sysinfo type="fwcfg">
+    <entry name="opt/com.coreos/config" file="/store/machines/domain/ignition.json"></entry>
+  </sysinfo>`)
+}
+
+func TestCloudInitSeedTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.StorePath = "/store"
+	d.CloudInitUserData = "#cloud-config\n"
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<disk type="file" device="cdrom">
+      <driver name="qemu" type="raw"></driver>
+      <source file="/store/machines/domain/cloud-init-seed.iso"></source>
+      <target dev="sda" bus="sata"></target>
+      <readonly></readonly>
+    </disk>`)
+	assert.Equal(t, "instance-id: domain\nlocal-hostname: domain\n", d.cloudInitMetaData())
+}
+
+func TestCheckFirstBootConfig(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkFirstBootConfig())
+
+	d.IgnitionConfig = `{"ignition": `
+	assert.Error(t, d.checkFirstBootConfig())
+
+	d.IgnitionConfig = `{"ignition": {"version": "3.1.0"}}`
+	assert.NoError(t, d.checkFirstBootConfig())
+	d.CloudInitUserData = "#cloud-config\n"
+	err := d.checkFirstBootConfig()
+	assert.True(t, errors.Is(err, ErrHostCheckFailed))
+	assert.Contains(t, err.Error(), "both an Ignition config and cloud-init user data are set")
+}
+
+func TestSetupFirstBootConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "firstboot")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	d := newTestDriver()
+	d.StorePath = dir
+	assert.NoError(t, os.MkdirAll(d.ResolveStorePath("."), 0755))
+	assert.NoError(t, ioutil.WriteFile(d.getIgnitionPath(), []byte("{}"), 0644))
+	d.IgnitionConfig = `{"ignition": {"version": "3.1.0"}}`
+	assert.NoError(t, d.setupFirstBootConfig())
+
+	info, err := os.Stat(d.getIgnitionPath())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	content, err := ioutil.ReadFile(d.getIgnitionPath())
+	assert.NoError(t, err)
+	assert.Equal(t, d.IgnitionConfig, string(content))
+}
@@ -0,0 +1,168 @@
+package libvirt
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/code-ready/machine/libmachine/state"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	GraphicsVNC   = "vnc"
+	GraphicsSpice = "spice"
+	GraphicsNone  = "none"
+
+	// libvirt only accepts VNC ports from 5900, display :0
+	minVNCPort = 5900
+	// Longer VNC passwords are truncated by qemu
+	maxVNCPasswordLength = 8
+)
+
+func (d *Driver) getGraphics() string {
+	if d.Graphics == "" {
+		return GraphicsVNC
+	}
+	return d.Graphics
+}
+
+func graphicsListeners(address string) []libvirtxml.DomainGraphicListener {
+	if address == "" {
+		return nil
+	}
+	return []libvirtxml.DomainGraphicListener{
+		{
+			Address: &libvirtxml.DomainGraphicListenerAddress{
+				Address: address,
+			},
+		},
+	}
+}
+
+func (d *Driver) graphicsAutoPort() string {
+	if d.GraphicsPort == 0 {
+		return ""
+	}
+	return "no"
+}
+
+// domainGraphics returns the remote display of the VM, libvirt picks a free
+// port when none is configured
+func domainGraphics(d *Driver) []libvirtxml.DomainGraphic {
+	switch d.getGraphics() {
+	case GraphicsVNC:
+		return []libvirtxml.DomainGraphic{
+			{
+				VNC: &libvirtxml.DomainGraphicVNC{
+					Port:      d.GraphicsPort,
+					AutoPort:  d.graphicsAutoPort(),
+					Passwd:    d.GraphicsPassword,
+					Listeners: graphicsListeners(d.GraphicsListen),
+				},
+			},
+		}
+	case GraphicsSpice:
+		return []libvirtxml.DomainGraphic{
+			{
+				Spice: &libvirtxml.DomainGraphicSpice{
+					Port:      d.GraphicsPort,
+					AutoPort:  d.graphicsAutoPort(),
+					Passwd:    d.GraphicsPassword,
+					Listeners: graphicsListeners(d.GraphicsListen),
+				},
+			},
+		}
+	}
+	return nil
+}
+
+func (d *Driver) checkGraphics() error {
+	graphics := d.getGraphics()
+	switch graphics {
+	case GraphicsVNC, GraphicsSpice, GraphicsNone:
+	default:
+		return &CheckError{
+			Check:  "graphics",
+			Reason: fmt.Sprintf("unsupported graphics '%s'", d.Graphics),
+			Hint:   "Use vnc, spice or none",
+		}
+	}
+	if d.GraphicsPort < 0 || d.GraphicsPort > 65535 || (graphics == GraphicsVNC && d.GraphicsPort != 0 && d.GraphicsPort < minVNCPort) {
+		return &CheckError{
+			Check:  "graphics",
+			Reason: fmt.Sprintf("invalid %s port %d", graphics, d.GraphicsPort),
+			Hint:   fmt.Sprintf("Use a port between %d and 65535, or 0 to pick a free one", minVNCPort),
+		}
+	}
+	if d.GraphicsListen != "" && net.ParseIP(d.GraphicsListen) == nil {
+		return &CheckError{
+			Check:  "graphics",
+			Reason: fmt.Sprintf("invalid listen address '%s'", d.GraphicsListen),
+			Hint:   "Use an IP address",
+		}
+	}
+	if graphics == GraphicsVNC && len(d.GraphicsPassword) > maxVNCPasswordLength {
+		log.Warnf("VNC passwords are limited to %d characters, the password will be truncated", maxVNCPasswordLength)
+	}
+	return nil
+}
+
+// connectAddress returns the address a viewer can connect to, for a display
+// listening on all the addresses this is the loopback address
+func connectAddress(listen string, listeners []libvirtxml.DomainGraphicListener) string {
+	for _, listener := range listeners {
+		if listener.Address != nil && listener.Address.Address != "" {
+			listen = listener.Address.Address
+			break
+		}
+	}
+	if ip := net.ParseIP(listen); ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+	return listen
+}
+
+// graphicsURL returns the address of the display of a running domain
+func graphicsURL(domain *libvirtxml.Domain) string {
+	if domain.Devices == nil {
+		return ""
+	}
+	for _, graphic := range domain.Devices.Graphics {
+		switch {
+		case graphic.VNC != nil && graphic.VNC.Port > 0:
+			address := connectAddress(graphic.VNC.Listen, graphic.VNC.Listeners)
+			return "vnc://" + net.JoinHostPort(address, strconv.Itoa(graphic.VNC.Port))
+		case graphic.Spice != nil && graphic.Spice.Port > 0:
+			address := connectAddress(graphic.Spice.Listen, graphic.Spice.Listeners)
+			return "spice://" + net.JoinHostPort(address, strconv.Itoa(graphic.Spice.Port))
+		}
+	}
+	return ""
+}
+
+// GetURL returns the vnc:// or spice:// address of the VM display, or an
+// empty string when the VM is not running or has no display
+func (d *Driver) GetURL() (string, error) {
+	if d.getGraphics() == GraphicsNone {
+		return "", nil
+	}
+	s, err := d.GetState()
+	if err != nil {
+		return "", err
+	}
+	if s != state.Running && s != state.Starting {
+		return "", nil
+	}
+	// The port is only known once the VM is running
+	xmldoc, err := d.vm.GetXMLDesc(0)
+	if err != nil {
+		return "", err
+	}
+	domain := &libvirtxml.Domain{}
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return "", err
+	}
+	return graphicsURL(domain), nil
+}
@@ -0,0 +1,73 @@
+package libvirt
+
+import (
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphicsTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.Graphics = GraphicsSpice
+	d.GraphicsListen = "0.0.0.0"
+	d.GraphicsPort = 5930
+	d.GraphicsPassword = "secret"
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<graphics type="spice" port="5930" autoport="no" passwd="secret">
+      <listen type="address" address="0.0.0.0"></listen>
+    </graphics>`)
+
+	d.Graphics = GraphicsNone
+	xml, err = domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.NotContains(t, xml, `<graphics`)
+}
+
+func TestGraphicsURL(t *testing.T) {
+	domain := &libvirtxml.Domain{}
+	assert.NoError(t, domain.Unmarshal(`<domain type="kvm">
+  <devices>
+    <graphics type="vnc" port="5901" autoport="yes" listen="127.0.0.1">
+      <listen type="address" address="127.0.0.1"></listen>
+    </graphics>
+  </devices>
+</domain>`))
+	assert.Equal(t, "vnc://127.0.0.1:5901", graphicsURL(domain))
+
+	domain = &libvirtxml.Domain{}
+	assert.NoError(t, domain.Unmarshal(`<domain type="kvm">
+  <devices>
+    <graphics type="spice" port="5902" autoport="yes" listen="::">
+      <listen type="address" address="::"></listen>
+    </graphics>
+  </devices>
+</domain>`))
+	assert.Equal(t, "spice://127.0.0.1:5902", graphicsURL(domain))
+
+	domain = &libvirtxml.Domain{}
+	assert.NoError(t, domain.Unmarshal(`<domain type="kvm">
+  <devices>
+    <graphics type="vnc" port="-1" autoport="yes"></graphics>
+  </devices>
+</domain>`))
+	assert.Equal(t, "", graphicsURL(domain))
+}
+
+func TestCheckGraphics(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkGraphics())
+
+	d.Graphics = "rdp"
+	assert.Error(t, d.checkGraphics())
+
+	d.Graphics = GraphicsVNC
+	d.GraphicsPort = 22
+	assert.Error(t, d.checkGraphics())
+
+	d.GraphicsPort = 0
+	d.GraphicsListen = "localhost"
+	assert.Error(t, d.checkGraphics())
+}
@@ -0,0 +1,177 @@
+package libvirt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Size of the chunks transferred by guest-file-read/write
+	guestFileChunkSize = 512 * 1024
+
+	guestExecPollInterval = 100 * time.Millisecond
+)
+
+// GuestExecResult holds the outcome of a command run by GuestExec
+type GuestExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+type guestExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	Signal   int    `json:"signal"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+func (status *guestExecStatus) result() (*GuestExecResult, error) {
+	stdout, err := base64.StdEncoding.DecodeString(status.OutData)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := base64.StdEncoding.DecodeString(status.ErrData)
+	if err != nil {
+		return nil, err
+	}
+	exitCode := status.ExitCode
+	if status.Signal != 0 {
+		// Same convention as shells for processes killed by a signal
+		exitCode = 128 + status.Signal
+	}
+	return &GuestExecResult{
+		ExitCode: exitCode,
+		Stdout:   stdout,
+		Stderr:   stderr,
+	}, nil
+}
+
+// guestExecArguments are the guest-exec arguments, qemu-ga rejects a null
+// argument list
+type guestExecArguments struct {
+	Path          string   `json:"path"`
+	Arg           []string `json:"arg,omitempty"`
+	CaptureOutput bool     `json:"capture-output"`
+}
+
+// GuestExec runs a command in the guest through the guest agent, waits for it
+// to complete and returns its exit code and output
+func (d *Driver) GuestExec(path string, args []string, timeout time.Duration) (*GuestExecResult, error) {
+	var pid struct {
+		PID int `json:"pid"`
+	}
+	err := d.guestAgentCommand("guest-exec", guestExecArguments{
+		Path:          path,
+		Arg:           args,
+		CaptureOutput: true,
+	}, &pid)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("Started %s in the guest with pid %d", path, pid.PID)
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status guestExecStatus
+		err := d.guestAgentCommand("guest-exec-status", map[string]interface{}{
+			"pid": pid.PID,
+		}, &status)
+		if err != nil {
+			return nil, err
+		}
+		if status.Exited {
+			return status.result()
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for %s to complete in the guest", path)
+		}
+		time.Sleep(guestExecPollInterval)
+	}
+}
+
+func (d *Driver) guestFileOpen(path, mode string) (int, error) {
+	var handle int
+	err := d.guestAgentCommand("guest-file-open", map[string]interface{}{
+		"path": path,
+		"mode": mode,
+	}, &handle)
+	return handle, err
+}
+
+func (d *Driver) guestFileClose(handle int) error {
+	return d.guestAgentCommand("guest-file-close", map[string]interface{}{
+		"handle": handle,
+	}, nil)
+}
+
+// CopyToGuest writes the content of src to path in the guest
+func (d *Driver) CopyToGuest(src io.Reader, path string) error {
+	handle, err := d.guestFileOpen(path, "w")
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, guestFileChunkSize)
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			err := d.guestAgentCommand("guest-file-write", map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(buf[:n]),
+			}, nil)
+			if err != nil {
+				_ = d.guestFileClose(handle)
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			_ = d.guestFileClose(handle)
+			return readErr
+		}
+	}
+	return d.guestFileClose(handle)
+}
+
+// CopyFromGuest writes the content of path in the guest to dst
+func (d *Driver) CopyFromGuest(path string, dst io.Writer) error {
+	handle, err := d.guestFileOpen(path, "r")
+	if err != nil {
+		return err
+	}
+	for {
+		var chunk struct {
+			Count  int    `json:"count"`
+			BufB64 string `json:"buf-b64"`
+			EOF    bool   `json:"eof"`
+		}
+		err := d.guestAgentCommand("guest-file-read", map[string]interface{}{
+			"handle": handle,
+			"count":  guestFileChunkSize,
+		}, &chunk)
+		if err != nil {
+			_ = d.guestFileClose(handle)
+			return err
+		}
+		data, err := base64.StdEncoding.DecodeString(chunk.BufB64)
+		if err != nil {
+			_ = d.guestFileClose(handle)
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			_ = d.guestFileClose(handle)
+			return err
+		}
+		if chunk.EOF || chunk.Count == 0 {
+			break
+		}
+	}
+	return d.guestFileClose(handle)
+}
@@ -0,0 +1,46 @@
+package libvirt
+
+import (
+	"fmt"
+	"os"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// domainKernelBoot makes QEMU load the kernel and initrd directly, skipping
+// the bootloader. The root filesystem is still on the disk image.
+func domainKernelBoot(d *Driver, domain *libvirtxml.Domain) {
+	if d.Kernel == "" {
+		return
+	}
+	domain.OS.Kernel = d.Kernel
+	domain.OS.Initrd = d.Initrd
+	domain.OS.Cmdline = d.KernelCmdline
+	domain.OS.BootDevices = nil
+}
+
+func (d *Driver) checkKernelBoot() error {
+	if d.Kernel == "" {
+		if d.Initrd != "" || d.KernelCmdline != "" {
+			return &CheckError{
+				Check:  "kernel",
+				Reason: "an initrd or kernel command line is set without a kernel",
+				Hint:   "Set the kernel path",
+			}
+		}
+		return nil
+	}
+	for _, path := range []string{d.Kernel, d.Initrd} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return &CheckError{
+				Check:  "kernel",
+				Reason: fmt.Sprintf("%s is not accessible: %v", path, err),
+				Hint:   "Fix the kernel and initrd paths",
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKernelBootTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.Kernel = "/boot/vmlinuz"
+	d.Initrd = "/boot/initramfs.img"
+	d.KernelCmdline = "root=/dev/vda4 console=ttyS0"
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<kernel>/boot/vmlinuz</kernel>
+    <initrd>/boot/initramfs.img</initrd>
+    <cmdline>root=/dev/vda4 console=ttyS0</cmdline>`)
+	assert.NotContains(t, xml, `<boot dev="hd">`)
+}
+
+func TestCheckKernelBoot(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkKernelBoot())
+
+	d.KernelCmdline = "console=ttyS0"
+	assert.Error(t, d.checkKernelBoot())
+
+	d.Kernel = "/nonexistent/vmlinuz"
+	assert.Error(t, d.checkKernelBoot())
+}
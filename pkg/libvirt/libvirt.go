@@ -20,10 +20,114 @@ import (
 type Driver struct {
 	*libvirtdriver.Driver
 
+	// Hostnames registered in the libvirt network DNS for the VM IP. A
+	// leading "*." label matches all the subdomains, eg. "*.apps.crc.testing"
+	DNSHostnames []string
+
+	// Create the network when it does not exist, and remove it once no
+	// domain uses it anymore
+	CreateNetwork    bool
+	NetworkBridge    string
+	NetworkSubnet    string
+	NetworkDHCPStart string
+	NetworkDHCPEnd   string
+
+	// One of "network" (default), "bridge" or "direct". The bridge and
+	// direct (macvtap) modes attach the VM to HostInterface, direct mode
+	// requires GuestAgent to find the VM IP address
+	NetworkMode   string
+	HostInterface string
+
+	// Fixed vsock context ID, automatically assigned when 0
+	VSockCID uint32
+
+	// Add a QEMU guest agent channel to the VM
+	GuestAgent bool
+	// Time of the last Start, used to report the VM as starting until its
+	// guest agent connects
+	StartedAt time.Time
+
+	// One of "kvm" (default), "tcg" for software emulation, or "auto" to
+	// fall back to tcg when kvm is not available
+	Accelerator string
+
+	// "host-passthrough" (default), "host-model" or a named CPU model
+	CPUModel    string
+	CPUFeatures []CPUFeature
+	// Guest CPU topology, the product must match the vCPU count
+	CPUSockets int
+	CPUCores   int
+	CPUThreads int
+
+	// Host CPUs each vCPU is pinned to, indexed by vCPU, in libvirt cpuset
+	// format ("2", "4-5,^5")
+	VCPUPins []string
+	// Host CPUs the QEMU emulator threads are pinned to
+	EmulatorPin string
+	// Host NUMA nodes the VM memory is strictly allocated from
+	NUMANodeset string
+	// "2M" or "1G" to back the VM memory with hugepages of this size
+	HugePageSize string
+
+	// "bios" (default) or "efi" to let libvirt pick an OVMF build
+	Firmware string
+	// Explicit OVMF code and variable store template paths, FirmwareLoader
+	// implies UEFI boot
+	FirmwareLoader        string
+	FirmwareNVRAMTemplate string
+	SecureBoot            bool
+
+	// Add an emulated TPM 2.0
+	TPM bool
+
+	// Boot this kernel directly instead of using the disk bootloader
+	Kernel        string
+	Initrd        string
+	KernelCmdline string
+
+	// Ignition config, passed to the guest through fw_cfg
+	IgnitionConfig string
+	// cloud-init NoCloud data, attached to the guest as a seed image
+	CloudInitUserData      string
+	CloudInitMetaData      string
+	CloudInitNetworkConfig string
+
+	// qemu machine type, defaults to q35 on x86 and virt on aarch64
+	MachineType string
+
+	// ISO images attached as cdrom drives, an empty path adds an empty drive
+	ISOImages []string
+	// "sata" (default on x86), "ide" (default on the x86 pc machine types)
+	// or "scsi" for virtio-scsi (default on aarch64)
+	CDROMBus string
+	// Boot devices in order: "hd", "cdrom" or "network", defaults to "hd"
+	BootOrder []string
+
+	// "vnc" (default), "spice" or "none"
+	Graphics       string
+	GraphicsListen string
+	// 0 lets libvirt pick a free port
+	GraphicsPort     int
+	GraphicsPassword string
+
+	// Partial <domain> XML merged into the generated definition
+	DomainXMLOverride string
+	// JSON merge patch (RFC 7396) applied to the generated definition, the
+	// keys are the libvirtxml.Domain field names
+	DomainPatch string
+	// Extra arguments passed as is to qemu
+	QemuArgs []string
+
 	// Libvirt connection and state
 	conn     *libvirt.Connect
 	vm       *libvirt.Domain
 	vmLoaded bool
+
+	// Accelerator and architecture resolved from the configuration and
+	// host capabilities
+	accelerator string
+	arch        string
+	hostCPU     *libvirtxml.CapsHostCPU
 }
 
 func (d *Driver) GetMachineName() string {
@@ -71,6 +175,9 @@ func (d *Driver) setVcpus(cpus uint) error {
 	if err := d.validateVMRef(); err != nil {
 		return err
 	}
+	if d.hasCPUTopology() {
+		return d.setVcpusTopology(cpus)
+	}
 
 	err := d.vm.SetVcpusFlags(cpus, libvirt.DOMAIN_VCPU_CONFIG|libvirt.DOMAIN_VCPU_MAXIMUM)
 	if err != nil {
@@ -86,6 +193,48 @@ func (d *Driver) setVcpus(cpus uint) error {
 	return nil
 }
 
+// setVcpusTopology changes the vCPU count of a VM with a CPU topology, which
+// SetVcpusFlags can't change. The VM is redefined with the scaled topology.
+func (d *Driver) setVcpusTopology(cpus uint) error {
+	cores, err := d.scaledCPUCores(int(cpus))
+	if err != nil {
+		return err
+	}
+	xmldoc, err := d.vm.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	if err != nil {
+		return err
+	}
+	domain := &libvirtxml.Domain{}
+	if err := domain.Unmarshal(xmldoc); err != nil {
+		return err
+	}
+	setDomainVCPUs(domain, cpus, &libvirtxml.DomainCPUTopology{
+		Sockets: d.CPUSockets,
+		Cores:   cores,
+		Threads: d.CPUThreads,
+	})
+	xml, err := domain.Marshal()
+	if err != nil {
+		return err
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	vm, err := conn.DomainDefineXMLFlags(xml, libvirt.DOMAIN_DEFINE_VALIDATE)
+	if err != nil {
+		return err
+	}
+	if err := d.vm.Free(); err != nil {
+		log.Debugf("Failed to free the previous domain reference: %v", err)
+	}
+	d.vm = vm
+
+	d.CPU = int(cpus)
+	d.CPUCores = cores
+	return nil
+}
+
 func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 	var newDriver libvirtdriver.Driver
 	err := json.Unmarshal(rawConfig, &newDriver)
@@ -121,16 +270,12 @@ func (d *Driver) UpdateConfigRaw(rawConfig []byte) error {
 	return nil
 }
 
-func (d *Driver) GetURL() (string, error) {
-	return "", nil
-}
-
 func (d *Driver) getConn() (*libvirt.Connect, error) {
 	if d.conn == nil {
 		conn, err := libvirt.NewConnect(connectionString)
 		if err != nil {
 			log.Errorf("Failed to connect to libvirt: %s", err)
-			return &libvirt.Connect{}, errors.New("Unable to connect to kvm driver, did you add yourself to the libvirtd group?")
+			return nil, newError(ErrConnectionFailed, connectionString, err)
 		}
 		d.conn = conn
 	}
@@ -139,28 +284,31 @@ func (d *Driver) getConn() (*libvirt.Connect, error) {
 
 // Create, or verify the private network is properly configured
 func (d *Driver) validateNetwork() error {
+	switch d.getNetworkMode() {
+	case NetworkModeNetwork:
+	case NetworkModeBridge, NetworkModeDirect:
+		log.Debugf("Validating host interface %s", d.HostInterface)
+		return d.validateHostInterface()
+	default:
+		return fmt.Errorf("unsupported networking mode: %s", d.NetworkMode)
+	}
 	if d.Network == "" {
 		return nil
 	}
 	log.Debug("Validating network")
-	conn, err := d.getConn()
-	if err != nil {
+	if err := validateDNSHostnames(d.DNSHostnames); err != nil {
 		return err
 	}
-	network, err := conn.LookupNetworkByName(d.Network)
+	network, err := d.getNetwork()
 	if err != nil {
-		return fmt.Errorf("Use 'crc setup' to define the network, %+v", err)
+		return err
 	}
 	defer network.Free() // nolint:errcheck
 
-	xmldoc, err := network.GetXMLDesc(0)
+	nw, err := getNetworkXML(network)
 	if err != nil {
 		return err
 	}
-	var nw libvirtxml.Network
-	if err := nw.Unmarshal(xmldoc); err != nil {
-		return err
-	}
 
 	if len(nw.IPs) != 1 {
 		return fmt.Errorf("unexpected number of IPs for network %s", d.Network)
@@ -168,6 +316,12 @@ func (d *Driver) validateNetwork() error {
 	if nw.IPs[0].Address == "" {
 		return fmt.Errorf("%s network doesn't have DHCP configured", d.Network)
 	}
+	routes, err := getHostRoutes()
+	if err != nil {
+		log.Warnf("Unable to read host routes, skipping subnet conflict check: %v", err)
+	} else if err := checkSubnetConflicts(nw, routes); err != nil {
+		return err
+	}
 	// Corner case, but might happen...
 	if active, err := network.IsActive(); !active {
 		log.Debugf("Reactivating network: %s", err)
@@ -186,16 +340,6 @@ func (d *Driver) PreCreateCheck() error {
 		return err
 	}
 
-	// TODO We could look at conn.GetCapabilities()
-	// parse the XML, and look for kvm
-	log.Debug("About to check libvirt version")
-
-	// TODO might want to check minimum version
-	_, err = conn.GetLibVersion()
-	if err != nil {
-		log.Warnf("Unable to get libvirt version")
-		return err
-	}
 	err = d.validateNetwork()
 	if err != nil {
 		return err
@@ -205,8 +349,8 @@ func (d *Driver) PreCreateCheck() error {
 	if err != nil {
 		return err
 	}
-	// Others...?
-	return nil
+
+	return runHostChecks(d.hostChecks(conn))
 }
 
 func (d *Driver) getDiskImageFilename() string {
@@ -257,41 +401,37 @@ func (d *Driver) setupDiskImage() error {
 	return nil
 }
 
-func getMachineType(conn *libvirt.Connect) (string, error) {
-	capsXML, err := conn.GetCapabilities()
+// resolveHostConfig resolves the parts of the VM definition which depend on
+// the host capabilities, and returns the machine type to use
+func (d *Driver) resolveHostConfig(conn *libvirt.Connect) (string, error) {
+	caps, err := getCapabilities(conn)
 	if err != nil {
 		return "", err
 	}
-	caps := &libvirtxml.Caps{}
-	err = caps.Unmarshal(capsXML)
+	machineType, err := d.getMachineType(caps)
 	if err != nil {
-		return "", fmt.Errorf("Error parsing libvirt capabilities: %w", err)
+		return "", err
 	}
-
-	var capsGuestArch *libvirtxml.CapsGuestArch
-	for _, guest := range caps.Guests {
-		if guest.OSType == "hvm" && guest.Arch.Name == caps.Host.CPU.Arch {
-			log.Debugf("Found %s hypervisor with 'hvm' capabilities", caps.Host.CPU.Arch)
-			capsGuestArch = &guest.Arch
-			break
-		}
+	if err := d.setupAccelerator(caps); err != nil {
+		return "", err
 	}
+	d.arch = caps.Host.CPU.Arch
+	d.hostCPU = caps.Host.CPU
+	return machineType, nil
+}
 
-	if capsGuestArch == nil {
-		return "", fmt.Errorf("Could not find a %s hypervisor with 'hvm' capabilities", caps.Host.CPU.Arch)
-	}
-	for _, machine := range capsGuestArch.Machines {
-		if machine.Name == "q35" || machine.Canonical == "q35" {
-			log.Debugf("Found q35 machine type")
-			return "q35", nil
+func (d *Driver) Create() error {
+	if err := d.create(); err != nil {
+		// Don't leave behind a network created for this VM
+		if err := d.removeNetworkIfUnused(); err != nil {
+			log.Warnf("Failed to remove network %s: %v", d.Network, err)
 		}
+		return err
 	}
-
-	log.Debugf("No q35 machine type")
-	return "", nil
+	return nil
 }
 
-func (d *Driver) Create() error {
+func (d *Driver) create() error {
 	err := d.setupDiskImage()
 	if err != nil {
 		return err
@@ -302,14 +442,21 @@ func (d *Driver) Create() error {
 	if err != nil {
 		return err
 	}
-	machineType, _ := getMachineType(conn)
+	machineType, err := d.resolveHostConfig(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := d.setupFirstBootConfig(); err != nil {
+		return err
+	}
 
 	xml, err := domainXML(d, machineType)
 	if err != nil {
 		return err
 	}
 
-	vm, err := conn.DomainDefineXML(xml)
+	vm, err := conn.DomainDefineXMLFlags(xml, libvirt.DOMAIN_DEFINE_VALIDATE)
 	if err != nil {
 		log.Warnf("Failed to create the VM: %s", err)
 		return err
@@ -364,12 +511,39 @@ func (d *Driver) Start() error {
 		d.DiskCapacity = diskCapacity
 	}
 
+	// A saved VM must be restored with the definition it was saved with,
+	// it's only updated when it's known to have no managed save image
+	restored, err := d.vm.HasManagedSaveImage(0)
+	if err != nil {
+		log.Debugf("Failed to check for a managed save image, not updating the VM definition: %v", err)
+	} else if !restored {
+		if err := d.reconcileDomain(); err != nil {
+			log.Warnf("Failed to update the VM definition: %v", err)
+		}
+	}
+
+	if err := d.rotateConsoleLog(); err != nil {
+		log.Warnf("Failed to rotate console log: %v", err)
+	}
+
+	if err := d.setupWildcardDNS(); err != nil {
+		return fmt.Errorf("Failed to register wildcard DNS entries for machine: %v", err)
+	}
+
 	if err := d.vm.Create(); err != nil {
 		log.Warnf("Failed to start: %s", err)
 		return err
 	}
+	d.StartedAt = time.Now()
 
-	if d.Network == "" {
+	if restored && d.GuestAgent {
+		log.Debugf("VM %s restored from a managed save image, resyncing its clock", d.MachineName)
+		if err := syncTimeWithRetry(d.SyncTime, nil); err != nil {
+			log.Warnf("%v", err)
+		}
+	}
+
+	if !d.hasNetworking() {
 		return nil
 	}
 
@@ -391,6 +565,9 @@ func (d *Driver) Start() error {
 		if ip != "" {
 			log.Infof("Found IP for machine: %s", ip)
 			d.IPAddress = ip
+			if err := d.addDNSHosts(ip); err != nil {
+				return fmt.Errorf("Failed to register DNS entries for machine: %v", err)
+			}
 			break
 		}
 		log.Debugf("Waiting for the VM to come up... %d", i)
@@ -398,7 +575,11 @@ func (d *Driver) Start() error {
 
 	if d.IPAddress == "" {
 		log.Warnf("Unable to determine VM's IP address, did it fail to boot?")
-		return fmt.Errorf("Unable to determine VM's IP address, did it fail to boot?")
+		console, err := d.GetConsoleLogTail(consoleErrorLines)
+		if err != nil || console == "" {
+			return fmt.Errorf("Unable to determine VM's IP address, did it fail to boot?")
+		}
+		return fmt.Errorf("Unable to determine VM's IP address, did it fail to boot? Last console output:\n%s", console)
 	}
 	return nil
 }
@@ -414,7 +595,12 @@ func (d *Driver) Stop() error {
 	}
 
 	if s != state.Stopped {
-		err := d.vm.Shutdown()
+		flags := libvirt.DOMAIN_SHUTDOWN_DEFAULT
+		if d.GuestAgent {
+			// libvirt falls back to ACPI if the agent is not responding
+			flags = libvirt.DOMAIN_SHUTDOWN_GUEST_AGENT | libvirt.DOMAIN_SHUTDOWN_ACPI_POWER_BTN
+		}
+		err := d.vm.ShutdownFlags(flags)
 		if err != nil {
 			log.Warnf("Failed to gracefully shutdown VM")
 			return err
@@ -441,7 +627,16 @@ func (d *Driver) Remove() error {
 	//       could take a snapshot.  If you do, then Undefine
 	//       will fail unless we nuke the snapshots first
 	_ = d.vm.Destroy() // Ignore errors
-	return d.vm.Undefine()
+	if err := d.removeDNSHosts(); err != nil {
+		log.Warnf("Failed to remove DNS entries for machine: %v", err)
+	}
+	if err := d.vm.UndefineFlags(d.undefineFlags()); err != nil {
+		return err
+	}
+	if err := d.removeNetworkIfUnused(); err != nil {
+		log.Warnf("Failed to remove network %s: %v", d.Network, err)
+	}
+	return nil
 }
 
 func (d *Driver) Restart() error {
@@ -471,6 +666,17 @@ func (d *Driver) GetState() (state.State, error) {
 	}
 	switch virState {
 	case libvirt.DOMAIN_RUNNING:
+		if d.GuestAgent && waitingForGuestAgent(d.StartedAt, time.Now()) {
+			// Until the guest agent is connected, the VM is still booting
+			connected, err := d.GuestAgentConnected()
+			if err != nil {
+				log.Debugf("Failed to get the guest agent state: %v", err)
+				return state.Running, nil
+			}
+			if !connected {
+				return state.Starting, nil
+			}
+		}
 		return state.Running, nil
 	case libvirt.DOMAIN_SHUTDOWN:
 		return state.Running, nil
@@ -494,7 +700,7 @@ func (d *Driver) validateVMRef() error {
 		vm, err := conn.LookupDomainByName(d.MachineName)
 		if err != nil {
 			log.Warnf("Failed to fetch machine")
-			return fmt.Errorf("Failed to fetch machine '%s'", d.MachineName)
+			return newError(ErrMachineNotFound, d.MachineName, err)
 		}
 		d.vm = vm
 		d.vmLoaded = true
@@ -508,24 +714,53 @@ func (d *Driver) GetIP() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("%v : machine in unknown state", err)
 	}
-	if s != state.Running {
+	if s != state.Running && s != state.Starting {
 		return "", errors.New("host is not running")
 	}
-	ifaces, err := d.vm.ListAllInterfaceAddresses(libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE)
-	if err != nil {
-		return "", err
+	var sources []libvirt.DomainInterfaceAddressesSource
+	switch d.getNetworkMode() {
+	case NetworkModeBridge:
+		// The host sees the VM traffic on the bridge, fall back to the
+		// guest agent if the ARP table has no entry yet
+		sources = []libvirt.DomainInterfaceAddressesSource{domainInterfaceAddressesSrcARP, libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT}
+	case NetworkModeDirect:
+		// macvtap traffic never reaches the host network stack
+		sources = []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_AGENT}
+	default:
+		sources = []libvirt.DomainInterfaceAddressesSource{libvirt.DOMAIN_INTERFACE_ADDRESSES_SRC_LEASE}
+	}
+	var lastErr error
+	for _, source := range sources {
+		ifaces, err := d.vm.ListAllInterfaceAddresses(source)
+		if err != nil {
+			log.Debugf("Failed to get interface addresses from source %d: %v", source, err)
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		if ip := findIPv4Address(ifaces); ip != "" {
+			log.Debugf("IP address: %s", ip)
+			return ip, nil
+		}
+	}
+	if d.getNetworkMode() != NetworkModeNetwork {
+		// the guest agent is typically not connected yet early during boot
+		return "", nil
 	}
+	return "", lastErr
+}
+
+func findIPv4Address(ifaces []libvirt.DomainInterface) string {
 	for _, iface := range ifaces {
 		if iface.Hwaddr == macAddress {
 			for _, addr := range iface.Addrs {
 				if addr.Type == int(libvirt.IP_ADDR_TYPE_IPV4) { // ipv4
-					log.Debugf("IP address: %s", addr.Addr)
-					return addr.Addr, nil
+					return addr.Addr
 				}
 			}
 		}
 	}
-	return "", nil
+	return ""
 }
 
 func NewDriver(hostName, storePath string) drivers.Driver {
@@ -0,0 +1,503 @@
+package libvirt
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+func (d *Driver) getNetworkMode() string {
+	if d.NetworkMode == "" {
+		return NetworkModeNetwork
+	}
+	return d.NetworkMode
+}
+
+// usesLibvirtNetwork returns true when the VM is attached to a libvirt
+// managed network, as opposed to a host bridge or NIC
+func (d *Driver) usesLibvirtNetwork() bool {
+	return d.getNetworkMode() == NetworkModeNetwork && d.Network != ""
+}
+
+func (d *Driver) hasNetworking() bool {
+	if d.getNetworkMode() == NetworkModeNetwork {
+		return d.Network != ""
+	}
+	return d.HostInterface != ""
+}
+
+// validateHostInterface checks the host bridge or NIC used by the bridge
+// and direct networking modes
+func (d *Driver) validateHostInterface() error {
+	mode := d.getNetworkMode()
+	// The host never sees the traffic of a macvtap interface, only the guest
+	// agent can report the VM address
+	if mode == NetworkModeDirect && !d.GuestAgent {
+		return fmt.Errorf("the %s networking mode requires the guest agent to find the VM IP address", mode)
+	}
+	if d.HostInterface == "" {
+		return fmt.Errorf("a host interface is required for the %s networking mode", mode)
+	}
+	iface, err := net.InterfaceByName(d.HostInterface)
+	if err != nil {
+		return fmt.Errorf("host interface %s not found: %v", d.HostInterface, err)
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		return fmt.Errorf("cannot use loopback interface %s for the %s networking mode", d.HostInterface, mode)
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("host interface %s is down", d.HostInterface)
+	}
+	_, err = os.Stat(filepath.Join("/sys/class/net", d.HostInterface, "bridge"))
+	isBridge := err == nil
+	switch mode {
+	case NetworkModeBridge:
+		if !isBridge {
+			return fmt.Errorf("host interface %s is not a Linux bridge", d.HostInterface)
+		}
+	case NetworkModeDirect:
+		if isBridge {
+			return fmt.Errorf("host interface %s is a bridge, use the %s networking mode instead", d.HostInterface, NetworkModeBridge)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) getNetwork() (*libvirt.Network, error) {
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	network, err := conn.LookupNetworkByName(d.Network)
+	if err != nil {
+		if !isLibvirtErrorCode(err, libvirt.ERR_NO_NETWORK) {
+			return nil, err
+		}
+		if !d.CreateNetwork {
+			return nil, newError(ErrNetworkNotFound, d.Network, err)
+		}
+		log.Debugf("Could not find network '%s', trying to create it", d.Network)
+		network, err := d.createNetwork()
+		if err != nil {
+			return nil, newError(ErrNetworkCreation, d.Network, err)
+		}
+		return network, nil
+	}
+	return network, nil
+}
+
+// nthIP returns the n-th address of the subnet
+func nthIP(subnet *net.IPNet, n int64) net.IP {
+	sum := new(big.Int).SetBytes(subnet.IP)
+	sum.Add(sum, big.NewInt(n))
+	b := sum.Bytes()
+	if len(b) > len(subnet.IP) {
+		// Wrap around past the last address
+		b = b[len(b)-len(subnet.IP):]
+	}
+	ip := make(net.IP, len(subnet.IP))
+	copy(ip[len(ip)-len(b):], b)
+	return ip
+}
+
+func (d *Driver) getNetworkSubnet() (*net.IPNet, error) {
+	if d.NetworkSubnet != "" {
+		_, subnet, err := net.ParseCIDR(d.NetworkSubnet)
+		if err != nil {
+			return nil, err
+		}
+		if subnet.IP.To4() == nil {
+			return nil, fmt.Errorf("network subnet %s is not an IPv4 subnet", d.NetworkSubnet)
+		}
+		subnet.IP = subnet.IP.To4()
+		return subnet, nil
+	}
+	routes, err := getHostRoutes()
+	if err != nil {
+		return nil, err
+	}
+	return pickFreeSubnet(routes)
+}
+
+func networkXML(name, bridge string, subnet *net.IPNet, dhcpStart, dhcpEnd string) (string, error) {
+	prefix, _ := subnet.Mask.Size()
+	if (dhcpStart == "" || dhcpEnd == "") && prefix > 24 {
+		return "", fmt.Errorf("a DHCP range must be configured for network subnets smaller than /24")
+	}
+	if dhcpStart == "" {
+		dhcpStart = nthIP(subnet, 2).String()
+	}
+	if dhcpEnd == "" {
+		dhcpEnd = nthIP(subnet, 254).String()
+	}
+	network := libvirtxml.Network{
+		Name: name,
+		Metadata: &libvirtxml.NetworkMetadata{
+			XML: networkMetadata,
+		},
+		Forward: &libvirtxml.NetworkForward{
+			Mode: "nat",
+		},
+		IPs: []libvirtxml.NetworkIP{
+			{
+				Address: nthIP(subnet, 1).String(),
+				Prefix:  uint(prefix),
+				DHCP: &libvirtxml.NetworkDHCP{
+					Ranges: []libvirtxml.NetworkDHCPRange{
+						{
+							Start: dhcpStart,
+							End:   dhcpEnd,
+						},
+					},
+				},
+			},
+		},
+	}
+	if bridge != "" {
+		network.Bridge = &libvirtxml.NetworkBridge{
+			Name: bridge,
+			STP:  "on",
+		}
+	}
+	return network.Marshal()
+}
+
+func (d *Driver) createNetwork() (*libvirt.Network, error) {
+	log.Debug("Creating network")
+
+	conn, err := d.getConn()
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := d.getNetworkSubnet()
+	if err != nil {
+		return nil, err
+	}
+	xml, err := networkXML(d.Network, d.NetworkBridge, subnet, d.NetworkDHCPStart, d.NetworkDHCPEnd)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Creating network with XML %s", xml)
+	network, err := conn.NetworkDefineXML(xml)
+	if err != nil {
+		return nil, err
+	}
+	if err := network.SetAutostart(true); err != nil {
+		log.Warnf("Failed to set autostart on network %s: %v", d.Network, err)
+	}
+	if err := network.Create(); err != nil {
+		log.Warnf("Failed to start network: %s", err)
+		if err := network.Undefine(); err != nil {
+			log.Warnf("Failed to undefine network %s: %v", d.Network, err)
+		}
+		_ = network.Free()
+		return nil, err
+	}
+	return network, nil
+}
+
+// createdByDriver returns true for the networks created by createNetwork,
+// other networks are never removed
+func createdByDriver(nw *libvirtxml.Network) bool {
+	return nw.Metadata != nil && strings.Contains(nw.Metadata.XML, metadataNamespace)
+}
+
+func domainUsesNetwork(domainXML string, network string) (bool, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(domainXML); err != nil {
+		return false, err
+	}
+	if domain.Devices == nil {
+		return false, nil
+	}
+	for _, iface := range domain.Devices.Interfaces {
+		if iface.Source != nil && iface.Source.Network != nil && iface.Source.Network.Network == network {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeNetworkIfUnused destroys and undefines the network when it was
+// created by the driver, and no libvirt domain is attached to it anymore
+func (d *Driver) removeNetworkIfUnused() error {
+	if !d.usesLibvirtNetwork() || !d.CreateNetwork {
+		return nil
+	}
+	conn, err := d.getConn()
+	if err != nil {
+		return err
+	}
+	network, err := conn.LookupNetworkByName(d.Network)
+	if err != nil {
+		// Already gone
+		return nil
+	}
+	defer network.Free() // nolint:errcheck
+
+	nw, err := getNetworkConfig(network)
+	if err != nil {
+		return err
+	}
+	if !createdByDriver(nw) {
+		log.Debugf("Network %s was not created by the driver, not removing it", d.Network)
+		return nil
+	}
+
+	domains, err := conn.ListAllDomains(0)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, domain := range domains {
+			_ = domain.Free()
+		}
+	}()
+	for _, domain := range domains {
+		xml, err := domain.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+		if err != nil {
+			return err
+		}
+		inUse, err := domainUsesNetwork(xml, d.Network)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			log.Debugf("Network %s is still in use, not removing it", d.Network)
+			return nil
+		}
+	}
+
+	log.Debugf("Removing network %s", d.Network)
+	if active, _ := network.IsActive(); active {
+		if err := network.Destroy(); err != nil {
+			return err
+		}
+	}
+	return network.Undefine()
+}
+
+func getNetworkXML(network *libvirt.Network) (*libvirtxml.Network, error) {
+	xmldoc, err := network.GetXMLDesc(0)
+	if err != nil {
+		return nil, err
+	}
+	var nw libvirtxml.Network
+	if err := nw.Unmarshal(xmldoc); err != nil {
+		return nil, err
+	}
+	return &nw, nil
+}
+
+func networkUpdateFlags(network *libvirt.Network) libvirt.NetworkUpdateFlags {
+	if active, _ := network.IsActive(); active {
+		return libvirt.NETWORK_UPDATE_AFFECT_LIVE | libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+	}
+	return libvirt.NETWORK_UPDATE_AFFECT_CONFIG
+}
+
+// networkIPSubnet returns the subnet served by a network <ip> element
+func networkIPSubnet(ip libvirtxml.NetworkIP) (*net.IPNet, error) {
+	addr := net.ParseIP(ip.Address)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid network address '%s'", ip.Address)
+	}
+	var mask net.IPMask
+	switch {
+	case ip.Prefix != 0:
+		bits := 8 * net.IPv6len
+		if addr.To4() != nil {
+			bits = 8 * net.IPv4len
+		}
+		mask = net.CIDRMask(int(ip.Prefix), bits)
+	case ip.Netmask != "":
+		netmask := net.ParseIP(ip.Netmask).To4()
+		if netmask == nil {
+			return nil, fmt.Errorf("invalid network netmask '%s'", ip.Netmask)
+		}
+		mask = net.IPMask(netmask)
+	default:
+		return nil, fmt.Errorf("network address %s has no prefix or netmask", ip.Address)
+	}
+	if v4 := addr.To4(); v4 != nil {
+		addr = v4
+	}
+	return &net.IPNet{
+		IP:   addr.Mask(mask),
+		Mask: mask,
+	}, nil
+}
+
+// checkSubnetConflicts fails if a route through another host interface is at
+// least as specific as the network subnet, in which case the VM would be
+// unreachable
+func checkSubnetConflicts(nw *libvirtxml.Network, routes []hostRoute) error {
+	bridge := ""
+	if nw.Bridge != nil {
+		bridge = nw.Bridge.Name
+	}
+	for _, ip := range nw.IPs {
+		subnet, err := networkIPSubnet(ip)
+		if err != nil {
+			return err
+		}
+		var otherRoutes []hostRoute
+		for _, route := range routes {
+			if route.Interface != bridge {
+				otherRoutes = append(otherRoutes, route)
+			}
+		}
+		if route := findConflictingRoute(subnet, otherRoutes); route != nil {
+			return fmt.Errorf("%s network subnet %s conflicts with %s on host interface %s (VPN, docker or other bridge?), "+
+				"disconnect it or use a different subnet for the %s network", nw.Name, subnet, route.Network, route.Interface, nw.Name)
+		}
+		if route := findOverlappingRoute(subnet, otherRoutes); route != nil {
+			log.Warnf("%s network subnet %s is inside %s on host interface %s, the addresses of the %s network are not reachable through %s",
+				nw.Name, subnet, route.Network, route.Interface, nw.Name, route.Interface)
+		}
+	}
+	return nil
+}
+
+// wildcardDomain returns the domain whose subdomains a "*.<domain>" name
+// matches
+func wildcardDomain(hostname string) (string, bool) {
+	if !strings.HasPrefix(hostname, "*.") {
+		return "", false
+	}
+	return strings.TrimPrefix(hostname, "*."), true
+}
+
+func validateDNSHostnames(hostnames []string) error {
+	for _, hostname := range hostnames {
+		name := hostname
+		if domain, ok := wildcardDomain(hostname); ok {
+			name = domain
+		}
+		// dnsmasq host records only support fully qualified names, and
+		// address options only match a domain with all its subdomains
+		if name == "" || strings.Contains(name, "*") {
+			return fmt.Errorf("invalid DNS name '%s', wildcards are only supported as a leading '*.' label", hostname)
+		}
+	}
+	return nil
+}
+
+// splitDNSHostnames separates the names registered as network host entries
+// from the wildcard domains, which are resolved with dnsmasq address options
+func splitDNSHostnames(hostnames []string) ([]string, []string) {
+	var hosts, domains []string
+	for _, hostname := range hostnames {
+		if domain, ok := wildcardDomain(hostname); ok {
+			domains = append(domains, domain)
+			continue
+		}
+		hosts = append(hosts, hostname)
+	}
+	return hosts, domains
+}
+
+func dnsHostXML(ip string, hostnames []string) (string, error) {
+	host := libvirtxml.NetworkDNSHost{
+		IP: ip,
+	}
+	for _, hostname := range hostnames {
+		host.Hostnames = append(host.Hostnames, libvirtxml.NetworkDNSHostHostname{
+			Hostname: hostname,
+		})
+	}
+	return host.Marshal()
+}
+
+// dnsHostMatches returns true if the host entry was registered for the
+// given IP, or if it claims one of the given hostnames
+func dnsHostMatches(host libvirtxml.NetworkDNSHost, ip string, hostnames []string) bool {
+	if ip != "" && host.IP == ip {
+		return true
+	}
+	for _, h := range host.Hostnames {
+		for _, hostname := range hostnames {
+			if h.Hostname == hostname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *Driver) deleteDNSHosts(network *libvirt.Network, ip string) error {
+	nw, err := getNetworkXML(network)
+	if err != nil {
+		return err
+	}
+	if nw.DNS == nil {
+		return nil
+	}
+	for _, host := range nw.DNS.Host {
+		if !dnsHostMatches(host, ip, d.DNSHostnames) {
+			continue
+		}
+		hostXML, err := host.Marshal()
+		if err != nil {
+			return err
+		}
+		log.Debugf("Removing DNS host entry %s from network %s", hostXML, d.Network)
+		err = network.Update(libvirt.NETWORK_UPDATE_COMMAND_DELETE, libvirt.NETWORK_SECTION_DNS_HOST, -1, hostXML, networkUpdateFlags(network))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Register the configured hostnames for the VM IP in the network dnsmasq
+func (d *Driver) addDNSHosts(ip string) error {
+	hosts, _ := splitDNSHostnames(d.DNSHostnames)
+	if !d.usesLibvirtNetwork() || len(hosts) == 0 {
+		return nil
+	}
+	network, err := d.getNetwork()
+	if err != nil {
+		return err
+	}
+	defer network.Free() // nolint:errcheck
+
+	// libvirt refuses to add a host entry if one with the same IP or
+	// hostname already exists, stale entries must be dropped first
+	if err := d.deleteDNSHosts(network, ip); err != nil {
+		return err
+	}
+	hostXML, err := dnsHostXML(ip, hosts)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Adding DNS host entry %s to network %s", hostXML, d.Network)
+	return network.Update(libvirt.NETWORK_UPDATE_COMMAND_ADD_LAST, libvirt.NETWORK_SECTION_DNS_HOST, -1, hostXML, networkUpdateFlags(network))
+}
+
+func (d *Driver) removeDNSHosts() error {
+	if !d.usesLibvirtNetwork() || len(d.DNSHostnames) == 0 {
+		return nil
+	}
+	// Don't create the network only to remove entries from it
+	network, err := d.lookupNetwork()
+	if isLibvirtErrorCode(err, libvirt.ERR_NO_NETWORK) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer network.Free() // nolint:errcheck
+
+	if err := d.removeWildcardDNS(network); err != nil {
+		return err
+	}
+	return d.deleteDNSHosts(network, d.IPAddress)
+}
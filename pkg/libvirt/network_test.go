@@ -0,0 +1,156 @@
+package libvirt
+
+import (
+	"net"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSHostTemplating(t *testing.T) {
+	xml, err := dnsHostXML("192.168.130.11", []string{"api.crc.testing", "oauth-openshift.apps-crc.testing"})
+	assert.NoError(t, err)
+	assert.Equal(t, `<host ip="192.168.130.11">
+  <hostname>api.crc.testing</hostname>
+  <hostname>oauth-openshift.apps-crc.testing</hostname>
+</host>`, xml)
+}
+
+func TestValidateDNSHostnames(t *testing.T) {
+	assert.NoError(t, validateDNSHostnames([]string{"api.crc.testing"}))
+	assert.NoError(t, validateDNSHostnames([]string{"api.crc.testing", "*.apps-crc.testing"}))
+	assert.Error(t, validateDNSHostnames([]string{"*"}))
+	assert.Error(t, validateDNSHostnames([]string{"*."}))
+	assert.Error(t, validateDNSHostnames([]string{"api.*.crc.testing"}))
+	assert.Error(t, validateDNSHostnames([]string{"*.*.crc.testing"}))
+}
+
+func TestDNSHostMatches(t *testing.T) {
+	host := libvirtxml.NetworkDNSHost{
+		IP: "192.168.130.11",
+		Hostnames: []libvirtxml.NetworkDNSHostHostname{
+			{Hostname: "api.crc.testing"},
+		},
+	}
+	assert.True(t, dnsHostMatches(host, "192.168.130.11", nil))
+	assert.True(t, dnsHostMatches(host, "192.168.130.12", []string{"api.crc.testing"}))
+	assert.False(t, dnsHostMatches(host, "192.168.130.12", []string{"foo.crc.testing"}))
+	assert.False(t, dnsHostMatches(host, "", nil))
+}
+
+func TestNetworkDefinitionTemplating(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.130.0/24")
+	xml, err := networkXML("crc", "virbr-crc", subnet, "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, `<network>
+  <name>crc</name>
+  <metadata><driver:network xmlns:driver="https://github.com/code-ready/machine-driver-libvirt"/></metadata>
+  <forward mode="nat"></forward>
+  <bridge name="virbr-crc" stp="on"></bridge>
+  <ip address="192.168.130.1" prefix="24">
+    <dhcp>
+      <range start="192.168.130.2" end="192.168.130.254"></range>
+    </dhcp>
+  </ip>
+</network>`, xml)
+
+	_, subnet, _ = net.ParseCIDR("192.168.130.0/28")
+	_, err = networkXML("crc", "", subnet, "", "")
+	assert.Error(t, err)
+}
+
+func TestNthIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.88.0.0/16")
+	subnet.IP = subnet.IP.To4()
+	assert.Equal(t, "10.88.0.1", nthIP(subnet, 1).String())
+	assert.Equal(t, "10.88.1.44", nthIP(subnet, 300).String())
+	assert.Equal(t, "10.88.255.254", nthIP(subnet, 65534).String())
+
+	_, subnet, _ = net.ParseCIDR("fd00::/64")
+	assert.Equal(t, "fd00::1:0", nthIP(subnet, 65536).String())
+}
+
+func TestCreatedByDriver(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.130.0/24")
+	xml, err := networkXML("crc", "", subnet, "", "")
+	assert.NoError(t, err)
+	var nw libvirtxml.Network
+	assert.NoError(t, nw.Unmarshal(xml))
+	assert.True(t, createdByDriver(&nw))
+
+	var other libvirtxml.Network
+	assert.NoError(t, other.Unmarshal(`<network><name>default</name></network>`))
+	assert.False(t, createdByDriver(&other))
+}
+
+func TestDomainUsesNetwork(t *testing.T) {
+	d := newTestDriver()
+	xml, err := domainXML(d, "")
+	assert.NoError(t, err)
+
+	inUse, err := domainUsesNetwork(xml, "crc")
+	assert.NoError(t, err)
+	assert.True(t, inUse)
+
+	inUse, err = domainUsesNetwork(xml, "default")
+	assert.NoError(t, err)
+	assert.False(t, inUse)
+}
+
+func TestNetworkIPSubnet(t *testing.T) {
+	subnet, err := networkIPSubnet(libvirtxml.NetworkIP{Address: "192.168.130.1", Prefix: 24})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.130.0/24", subnet.String())
+
+	subnet, err = networkIPSubnet(libvirtxml.NetworkIP{Address: "192.168.130.1", Netmask: "255.255.255.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.130.0/24", subnet.String())
+
+	_, err = networkIPSubnet(libvirtxml.NetworkIP{Address: "192.168.130.1"})
+	assert.Error(t, err)
+}
+
+func TestCheckSubnetConflicts(t *testing.T) {
+	nw := &libvirtxml.Network{
+		Name: "crc",
+		Bridge: &libvirtxml.NetworkBridge{
+			Name: "crc",
+		},
+		IPs: []libvirtxml.NetworkIP{
+			{Address: "192.168.130.1", Netmask: "255.255.255.0"},
+		},
+	}
+	_, bridgeNet, _ := net.ParseCIDR("192.168.130.0/24")
+	_, vpnNet, _ := net.ParseCIDR("192.168.128.0/17")
+	_, vpnHostNet, _ := net.ParseCIDR("192.168.130.128/25")
+	routes := []hostRoute{
+		{Interface: "crc", Network: bridgeNet},
+	}
+	assert.NoError(t, checkSubnetConflicts(nw, routes))
+
+	// Longest prefix match still routes the subnet to the bridge
+	routes = append(routes, hostRoute{Interface: "tun0", Network: vpnNet})
+	assert.NoError(t, checkSubnetConflicts(nw, routes))
+
+	routes = append(routes, hostRoute{Interface: "tun1", Network: vpnHostNet})
+	err := checkSubnetConflicts(nw, routes)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tun1")
+
+	routes[2] = hostRoute{Interface: "tun1", Network: bridgeNet}
+	assert.Error(t, checkSubnetConflicts(nw, routes))
+}
+
+func TestValidateHostInterfaceDirect(t *testing.T) {
+	d := newTestDriver()
+	d.NetworkMode = NetworkModeDirect
+	d.HostInterface = "lo"
+	err := d.validateHostInterface()
+	assert.EqualError(t, err, "the direct networking mode requires the guest agent to find the VM IP address")
+
+	// Past the guest agent check, the loopback interface is rejected
+	d.GuestAgent = true
+	err = d.validateHostInterface()
+	assert.EqualError(t, err, "cannot use loopback interface lo for the direct networking mode")
+}
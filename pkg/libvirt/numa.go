@@ -0,0 +1,245 @@
+package libvirt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// Hugepage sizes in kiB
+var hugePageSizes = map[string]uint64{
+	"2M": 2 * 1024,
+	"1G": 1024 * 1024,
+}
+
+const sysfsNodes = "/sys/devices/system/node"
+
+// parseCPUSet parses a libvirt cpuset/nodeset string such as "0-3,^2,6"
+func parseCPUSet(cpuset string) (map[int]bool, error) {
+	ids := map[int]bool{}
+	var excluded []int
+	for _, part := range strings.Split(cpuset, ",") {
+		part = strings.TrimSpace(part)
+		exclude := strings.HasPrefix(part, "^")
+		part = strings.TrimPrefix(part, "^")
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpuset '%s'", cpuset)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil || end < start {
+				return nil, fmt.Errorf("invalid cpuset '%s'", cpuset)
+			}
+		}
+		for id := start; id <= end; id++ {
+			if exclude {
+				excluded = append(excluded, id)
+			} else {
+				ids[id] = true
+			}
+		}
+	}
+	for _, id := range excluded {
+		delete(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("cpuset '%s' is empty", cpuset)
+	}
+	return ids, nil
+}
+
+func (d *Driver) hasNUMATuning() bool {
+	return len(d.VCPUPins) != 0 || d.EmulatorPin != "" || d.NUMANodeset != "" || d.HugePageSize != ""
+}
+
+func domainCPUTune(d *Driver) *libvirtxml.DomainCPUTune {
+	if len(d.VCPUPins) == 0 && d.EmulatorPin == "" {
+		return nil
+	}
+	cputune := &libvirtxml.DomainCPUTune{}
+	for vcpu, cpuset := range d.VCPUPins {
+		if cpuset == "" {
+			continue
+		}
+		cputune.VCPUPin = append(cputune.VCPUPin, libvirtxml.DomainCPUTuneVCPUPin{
+			VCPU:   uint(vcpu),
+			CPUSet: cpuset,
+		})
+	}
+	if d.EmulatorPin != "" {
+		cputune.EmulatorPin = &libvirtxml.DomainCPUTuneEmulatorPin{
+			CPUSet: d.EmulatorPin,
+		}
+	}
+	return cputune
+}
+
+func domainNUMATune(d *Driver) *libvirtxml.DomainNUMATune {
+	if d.NUMANodeset == "" {
+		return nil
+	}
+	return &libvirtxml.DomainNUMATune{
+		Memory: &libvirtxml.DomainNUMATuneMemory{
+			Mode:    "strict",
+			Nodeset: d.NUMANodeset,
+		},
+	}
+}
+
+func domainMemoryBacking(d *Driver) *libvirtxml.DomainMemoryBacking {
+	size, ok := hugePageSizes[d.HugePageSize]
+	if !ok {
+		return nil
+	}
+	return &libvirtxml.DomainMemoryBacking{
+		MemoryHugePages: &libvirtxml.DomainMemoryHugepages{
+			Hugepages: []libvirtxml.DomainMemoryHugepage{
+				{
+					Size: uint(size),
+					Unit: "KiB",
+				},
+			},
+		},
+	}
+}
+
+// hostNUMATopology returns the host CPUs of each NUMA node
+func hostNUMATopology(caps *libvirtxml.Caps) map[int]map[int]bool {
+	nodes := map[int]map[int]bool{}
+	if caps.Host.NUMA == nil || caps.Host.NUMA.Cells == nil {
+		return nodes
+	}
+	for _, cell := range caps.Host.NUMA.Cells.Cells {
+		cpus := map[int]bool{}
+		if cell.CPUS != nil {
+			for _, cpu := range cell.CPUS.CPUs {
+				cpus[cpu.ID] = true
+			}
+		}
+		nodes[cell.ID] = cpus
+	}
+	return nodes
+}
+
+func checkCPUSet(name, cpuset string, hostCPUs map[int]bool) error {
+	cpus, err := parseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+	for cpu := range cpus {
+		if !hostCPUs[cpu] {
+			return fmt.Errorf("%s uses host CPU %d which does not exist", name, cpu)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) checkNUMAConfig(topology map[int]map[int]bool) error {
+	hostCPUs := map[int]bool{}
+	for _, cpus := range topology {
+		for cpu := range cpus {
+			hostCPUs[cpu] = true
+		}
+	}
+	if len(d.VCPUPins) > d.CPU {
+		return fmt.Errorf("%d vCPU pins configured for %d vCPUs", len(d.VCPUPins), d.CPU)
+	}
+	for vcpu, cpuset := range d.VCPUPins {
+		if cpuset == "" {
+			continue
+		}
+		if err := checkCPUSet(fmt.Sprintf("vCPU %d pinning", vcpu), cpuset, hostCPUs); err != nil {
+			return err
+		}
+	}
+	if d.EmulatorPin != "" {
+		if err := checkCPUSet("emulator pinning", d.EmulatorPin, hostCPUs); err != nil {
+			return err
+		}
+	}
+	if d.NUMANodeset != "" {
+		nodes, err := parseCPUSet(d.NUMANodeset)
+		if err != nil {
+			return err
+		}
+		for node := range nodes {
+			if _, ok := topology[node]; !ok {
+				return fmt.Errorf("host NUMA node %d does not exist", node)
+			}
+		}
+	}
+	if d.HugePageSize != "" {
+		if _, ok := hugePageSizes[d.HugePageSize]; !ok {
+			return fmt.Errorf("unsupported hugepage size '%s', use 2M or 1G", d.HugePageSize)
+		}
+	}
+	return nil
+}
+
+// freeHugePages returns the number of free hugepages of the given size, in
+// kiB, on a host NUMA node. virNodeGetFreePages isn't used as the vendored
+// bindings pass the Go slice headers instead of the arrays to C.
+func freeHugePages(node int, sizeKiB uint64) (uint64, error) {
+	path := filepath.Join(sysfsNodes, fmt.Sprintf("node%d", node), "hugepages",
+		fmt.Sprintf("hugepages-%dkB", sizeKiB), "free_hugepages")
+	data, err := ioutil.ReadFile(path) // #nosec G304
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (d *Driver) checkFreeHugePages(topology map[int]map[int]bool) error {
+	size, ok := hugePageSizes[d.HugePageSize]
+	if !ok {
+		return nil
+	}
+	nodes := map[int]bool{}
+	if d.NUMANodeset != "" {
+		var err error
+		if nodes, err = parseCPUSet(d.NUMANodeset); err != nil {
+			return err
+		}
+	} else {
+		for node := range topology {
+			nodes[node] = true
+		}
+	}
+	var free uint64
+	for node := range nodes {
+		pages, err := freeHugePages(node, size)
+		if err != nil {
+			return err
+		}
+		free += pages
+	}
+	required := (convertMiBToKiB(d.Memory) + size - 1) / size
+	if free < required {
+		return &CheckError{
+			Check:  "hugepages",
+			Reason: fmt.Sprintf("%d free %s hugepages are required, only %d are available", required, d.HugePageSize, free),
+			Hint:   fmt.Sprintf("Reserve more %s hugepages with sysctl vm.nr_hugepages or on the kernel command line", d.HugePageSize),
+		}
+	}
+	return nil
+}
+
+// checkNUMA validates the pinning, NUMA and hugepage configuration against
+// the host topology
+func (d *Driver) checkNUMA(caps *libvirtxml.Caps) error {
+	topology := hostNUMATopology(caps)
+	if err := d.checkNUMAConfig(topology); err != nil {
+		return &CheckError{
+			Check:  "numa",
+			Reason: err.Error(),
+			Hint:   "Check the host topology with 'virsh capabilities'",
+		}
+	}
+	return d.checkFreeHugePages(topology)
+}
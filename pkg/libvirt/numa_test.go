@@ -0,0 +1,83 @@
+package libvirt
+
+import (
+	"errors"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCPUSet(t *testing.T) {
+	cpus, err := parseCPUSet("0-3,^2,6")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]bool{0: true, 1: true, 3: true, 6: true}, cpus)
+
+	_, err = parseCPUSet("3-1")
+	assert.Error(t, err)
+	_, err = parseCPUSet("a")
+	assert.Error(t, err)
+	_, err = parseCPUSet("1,^1")
+	assert.Error(t, err)
+}
+
+func TestNUMATemplating(t *testing.T) {
+	d := newTestDriver()
+	d.VCPUPins = []string{"2", "", "4-5"}
+	d.EmulatorPin = "0-1"
+	d.NUMANodeset = "1"
+	d.HugePageSize = "1G"
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<memoryBacking>
+    <hugepages>
+      <page size="1048576" unit="KiB"></page>
+    </hugepages>
+  </memoryBacking>`)
+	assert.Contains(t, xml, `<cputune>
+    <vcpupin vcpu="0" cpuset="2"></vcpupin>
+    <vcpupin vcpu="2" cpuset="4-5"></vcpupin>
+    <emulatorpin cpuset="0-1"></emulatorpin>
+  </cputune>`)
+	assert.Contains(t, xml, `<numatune>
+    <memory mode="strict" nodeset="1"></memory>
+  </numatune>`)
+}
+
+func TestCheckNUMAConfig(t *testing.T) {
+	caps := &libvirtxml.Caps{
+		Host: libvirtxml.CapsHost{
+			NUMA: &libvirtxml.CapsHostNUMATopology{
+				Cells: &libvirtxml.CapsHostNUMACells{
+					Cells: []libvirtxml.CapsHostNUMACell{
+						{ID: 0, CPUS: &libvirtxml.CapsHostNUMACPUs{CPUs: []libvirtxml.CapsHostNUMACPU{{ID: 0}, {ID: 1}}}},
+						{ID: 1, CPUS: &libvirtxml.CapsHostNUMACPUs{CPUs: []libvirtxml.CapsHostNUMACPU{{ID: 2}, {ID: 3}}}},
+					},
+				},
+			},
+		},
+	}
+	topology := hostNUMATopology(caps)
+
+	d := newTestDriver()
+	d.VCPUPins = []string{"0", "1", "2-3"}
+	d.EmulatorPin = "0"
+	d.NUMANodeset = "0-1"
+	assert.NoError(t, d.checkNUMAConfig(topology))
+
+	d.VCPUPins = []string{"4"}
+	assert.Error(t, d.checkNUMAConfig(topology))
+
+	d.VCPUPins = []string{"0", "0", "0", "0", "0"}
+	assert.Error(t, d.checkNUMAConfig(topology))
+
+	d.VCPUPins = nil
+	d.NUMANodeset = "2"
+	assert.Error(t, d.checkNUMAConfig(topology))
+
+	d.NUMANodeset = ""
+	d.HugePageSize = "4M"
+	assert.Error(t, d.checkNUMAConfig(topology))
+	assert.True(t, errors.Is(d.checkNUMA(caps), ErrHostCheckFailed))
+}
@@ -0,0 +1,150 @@
+package libvirt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+// mergePatch applies a JSON merge patch (RFC 7396) to target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
+
+// applyDomainPatch applies a JSON merge patch to the JSON representation of
+// the domain, where keys are the libvirtxml field names
+func applyDomainPatch(domain *libvirtxml.Domain, patch string) error {
+	var patchObj interface{}
+	if err := json.Unmarshal([]byte(patch), &patchObj); err != nil {
+		return fmt.Errorf("Error parsing the domain patch: %w", err)
+	}
+	if _, ok := patchObj.(map[string]interface{}); !ok {
+		return fmt.Errorf("the domain patch must be a JSON object")
+	}
+	data, err := json.Marshal(domain)
+	if err != nil {
+		return err
+	}
+	var domainObj interface{}
+	if err := json.Unmarshal(data, &domainObj); err != nil {
+		return err
+	}
+	data, err = json.Marshal(mergePatch(domainObj, patchObj))
+	if err != nil {
+		return err
+	}
+	patched := libvirtxml.Domain{}
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return fmt.Errorf("Error applying the domain patch: %w", err)
+	}
+	*domain = patched
+	return nil
+}
+
+// applyDomainOverrides merges the user provided XML, patch and qemu
+// arguments into the generated domain. The XML is decoded over the generated
+// definition: attributes and single elements replace the generated ones,
+// while repeated elements such as devices are added.
+func applyDomainOverrides(d *Driver, domain *libvirtxml.Domain) error {
+	if d.DomainXMLOverride != "" {
+		if err := domain.Unmarshal(d.DomainXMLOverride); err != nil {
+			return fmt.Errorf("Error parsing the domain XML override: %w", err)
+		}
+	}
+	if d.DomainPatch != "" {
+		if err := applyDomainPatch(domain, d.DomainPatch); err != nil {
+			return err
+		}
+	}
+	if len(d.QemuArgs) != 0 {
+		if domain.QEMUCommandline == nil {
+			domain.QEMUCommandline = &libvirtxml.DomainQEMUCommandline{}
+		}
+		for _, arg := range d.QemuArgs {
+			domain.QEMUCommandline.Args = append(domain.QEMUCommandline.Args, libvirtxml.DomainQEMUCommandlineArg{
+				Value: arg,
+			})
+		}
+	}
+	return nil
+}
+
+// overridesDigest identifies the XML override and patch a domain was defined
+// with, they can't be compared once merged into the definition
+func (d *Driver) overridesDigest() string {
+	if d.DomainXMLOverride == "" && d.DomainPatch == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(d.DomainXMLOverride + "\x00" + d.DomainPatch))
+	return hex.EncodeToString(sum[:])
+}
+
+// domainOverridesMetadata records the overrides digest in the domain metadata
+func domainOverridesMetadata(d *Driver, domain *libvirtxml.Domain) {
+	digest := d.overridesDigest()
+	if digest == "" {
+		return
+	}
+	if domain.Metadata == nil {
+		domain.Metadata = &libvirtxml.DomainMetadata{}
+	}
+	domain.Metadata.XML += fmt.Sprintf(`<driver:overrides xmlns:driver="%s" digest="%s"/>`, metadataNamespace, digest)
+}
+
+// metadataOverridesDigest returns the overrides digest recorded in the domain
+// metadata, libvirt may change the namespace prefix
+func metadataOverridesDigest(domain *libvirtxml.Domain) string {
+	if domain.Metadata == nil {
+		return ""
+	}
+	decoder := xml.NewDecoder(strings.NewReader(domain.Metadata.XML))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != metadataNamespace || start.Name.Local != "overrides" {
+			continue
+		}
+		for _, attr := range start.Attr {
+			if attr.Name.Local == "digest" {
+				return attr.Value
+			}
+		}
+	}
+}
+
+func (d *Driver) checkDomainOverrides() error {
+	if d.DomainXMLOverride == "" && d.DomainPatch == "" {
+		return nil
+	}
+	if err := applyDomainOverrides(d, &libvirtxml.Domain{}); err != nil {
+		return &CheckError{
+			Check:  "domain-overrides",
+			Reason: err.Error(),
+			Hint:   "Fix the domain XML override or patch",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainXMLOverride(t *testing.T) {
+	d := newTestDriver()
+	d.DomainXMLOverride = `<domain>
+  <memory unit="MiB">8192</memory>
+  <devices>
+    <watchdog model="i6300esb" action="reset"></watchdog>
+  </devices>
+</domain>`
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<domain type="kvm">
+  <name>domain</name>
+  <metadata><driver:overrides xmlns:driver="https://github.com/code-ready/machine-driver-libvirt" digest="`+d.overridesDigest()+`"/></metadata>
+  <memory unit="MiB">8192</memory>`)
+	assert.Contains(t, xml, `<target dev="vda" bus="virtio"></target>`)
+	assert.Contains(t, xml, `<watchdog model="i6300esb" action="reset"></watchdog>`)
+}
+
+func TestDomainPatch(t *testing.T) {
+	d := newTestDriver()
+	d.DomainPatch = `{"Devices": {"MemBalloon": null}, "OnCrash": "preserve"}`
+	d.QemuArgs = []string{"-fw_cfg", "name=opt/test,string=1"}
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<on_crash>preserve</on_crash>`)
+	assert.Contains(t, xml, `<target dev="vda" bus="virtio"></target>`)
+	assert.NotContains(t, xml, `<memballoon`)
+	assert.Contains(t, xml, `<commandline xmlns="http://libvirt.org/schemas/domain/qemu/1.0">
+    <arg value="-fw_cfg"></arg>
+    <arg value="name=opt/test,string=1"></arg>
+  </commandline>`)
+}
+
+func TestCheckDomainOverrides(t *testing.T) {
+	d := newTestDriver()
+	assert.NoError(t, d.checkDomainOverrides())
+
+	d.DomainXMLOverride = `<domain><devices>`
+	assert.Error(t, d.checkDomainOverrides())
+
+	d.DomainXMLOverride = ""
+	d.DomainPatch = `["not", "an", "object"]`
+	assert.Error(t, d.checkDomainOverrides())
+}
@@ -0,0 +1,157 @@
+package libvirt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+const procNetRoute = "/proc/net/route"
+
+type hostRoute struct {
+	Interface string
+	Network   *net.IPNet
+}
+
+// parseProcNetRoute parses the IPv4 routing table in the /proc/net/route format
+func parseProcNetRoute(r io.Reader) ([]hostRoute, error) {
+	var routes []hostRoute
+	scanner := bufio.NewScanner(r)
+	// Skip header line
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		dest, err := parseProcNetRouteIP(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		mask, err := parseProcNetRouteIP(fields[7])
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, hostRoute{
+			Interface: fields[0],
+			Network: &net.IPNet{
+				IP:   dest,
+				Mask: net.IPMask(mask),
+			},
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// /proc/net/route stores addresses as little endian hex strings
+func parseProcNetRouteIP(s string) (net.IP, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return nil, fmt.Errorf("invalid address '%s' in %s", s, procNetRoute)
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(b))
+	return ip, nil
+}
+
+// getHostRoutes returns the IPv4 networks reachable through the host
+// interfaces, default routes excluded
+func getHostRoutes() ([]hostRoute, error) {
+	f, err := os.Open(procNetRoute)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	procRoutes, err := parseProcNetRoute(f)
+	if err != nil {
+		return nil, err
+	}
+	var routes []hostRoute
+	for _, route := range procRoutes {
+		if ones, _ := route.Network.Mask.Size(); ones == 0 {
+			continue
+		}
+		routes = append(routes, route)
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || ipNet.IP.IsLoopback() {
+				continue
+			}
+			routes = append(routes, hostRoute{
+				Interface: iface.Name,
+				Network: &net.IPNet{
+					IP:   ipNet.IP.Mask(ipNet.Mask),
+					Mask: ipNet.Mask,
+				},
+			})
+		}
+	}
+	return routes, nil
+}
+
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// findOverlappingRoute returns a route sharing addresses with the subnet
+func findOverlappingRoute(subnet *net.IPNet, routes []hostRoute) *hostRoute {
+	for i := range routes {
+		if subnetsOverlap(subnet, routes[i].Network) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// findConflictingRoute returns an overlapping route at least as specific as
+// the subnet, which takes over some of its traffic. Broader routes, such as
+// the 10.0.0.0/8 route of a VPN, are harmless: longest prefix match still
+// sends the subnet traffic to its own interface.
+func findConflictingRoute(subnet *net.IPNet, routes []hostRoute) *hostRoute {
+	subnetOnes, _ := subnet.Mask.Size()
+	for i := range routes {
+		routeOnes, _ := routes[i].Network.Mask.Size()
+		if routeOnes >= subnetOnes && subnetsOverlap(subnet, routes[i].Network) {
+			return &routes[i]
+		}
+	}
+	return nil
+}
+
+// pickFreeSubnet returns the first 192.168.x.0/24 subnet, starting from
+// DefaultNetworkSubnet, which does not collide with the given routes. A
+// subnet only covered by broader routes is used when none is free.
+func pickFreeSubnet(routes []hostRoute) (*net.IPNet, error) {
+	for _, find := range []func(*net.IPNet, []hostRoute) *hostRoute{findOverlappingRoute, findConflictingRoute} {
+		_, subnet, err := net.ParseCIDR(DefaultNetworkSubnet)
+		if err != nil {
+			return nil, err
+		}
+		for ; subnet.IP[2] < 255; subnet.IP[2]++ {
+			if find(subnet, routes) == nil {
+				return subnet, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not find a free subnet for network")
+}
@@ -0,0 +1,78 @@
+package libvirt
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const procNetRouteContent = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+`
+
+func TestParseProcNetRoute(t *testing.T) {
+	routes, err := parseProcNetRoute(strings.NewReader(procNetRouteContent))
+	assert.NoError(t, err)
+	assert.Len(t, routes, 3)
+	assert.Equal(t, "eth0", routes[1].Interface)
+	assert.Equal(t, "192.168.2.0/24", routes[1].Network.String())
+	assert.Equal(t, "docker0", routes[2].Interface)
+	assert.Equal(t, "172.17.0.0/16", routes[2].Network.String())
+}
+
+func TestPickFreeSubnet(t *testing.T) {
+	_, taken, _ := net.ParseCIDR("192.168.130.0/23")
+	subnet, err := pickFreeSubnet([]hostRoute{
+		{
+			Interface: "tun0",
+			Network:   taken,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.132.0/24", subnet.String())
+
+	// Only subnets inside broader routes are left
+	_, vpn, _ := net.ParseCIDR("192.168.0.0/16")
+	_, taken, _ = net.ParseCIDR("192.168.130.0/24")
+	subnet, err = pickFreeSubnet([]hostRoute{
+		{
+			Interface: "eth0",
+			Network:   taken,
+		},
+		{
+			Interface: "tun1",
+			Network:   vpn,
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.131.0/24", subnet.String())
+}
+
+func TestFindConflictingRoute(t *testing.T) {
+	routes, err := parseProcNetRoute(strings.NewReader(procNetRouteContent))
+	assert.NoError(t, err)
+
+	// docker0 is a broader /16, the /24 is still routed to its own bridge
+	_, subnet, _ := net.ParseCIDR("172.17.42.0/24")
+	assert.Nil(t, findConflictingRoute(subnet, routes[1:]))
+	route := findOverlappingRoute(subnet, routes[1:])
+	assert.NotNil(t, route)
+	assert.Equal(t, "docker0", route.Interface)
+
+	_, subnet, _ = net.ParseCIDR("172.16.0.0/12")
+	route = findConflictingRoute(subnet, routes[1:])
+	assert.NotNil(t, route)
+	assert.Equal(t, "docker0", route.Interface)
+
+	_, subnet, _ = net.ParseCIDR("192.168.2.0/24")
+	route = findConflictingRoute(subnet, routes[1:])
+	assert.NotNil(t, route)
+	assert.Equal(t, "eth0", route.Interface)
+
+	_, subnet, _ = net.ParseCIDR("192.168.130.0/24")
+	assert.Nil(t, findConflictingRoute(subnet, routes[1:]))
+}
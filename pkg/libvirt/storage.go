@@ -30,8 +30,7 @@ func (d *Driver) validateStoragePool() error {
 	log.Debug("Validating storage pool")
 	pool, err := d.getPool()
 	if err != nil {
-		/* FIXME: not the right place to talk about 'crc setup' */
-		return fmt.Errorf("Use 'crc setup' to define the machine driver storage pool, %+v", err)
+		return err
 	}
 	defer pool.Free() // nolint:errcheck
 
@@ -79,11 +78,12 @@ func (d *Driver) createStoragePool() (*libvirt.StoragePool, error) {
 	pool, err := conn.StoragePoolDefineXML(poolXML, uint32(libvirt.STORAGE_POOL_CREATE_NORMAL))
 	if err != nil {
 		log.Debugf("Could not create storage pool %s", d.StoragePool)
-		return nil, fmt.Errorf("Use 'crc setup' to define the storage pool, %+v", err)
+		return nil, newError(ErrStoragePoolCreation, poolName, err)
 	}
 	err = d.activateStoragePool(pool)
 	if err != nil {
-		return nil, err
+		_ = pool.Free()
+		return nil, newError(ErrStoragePoolCreation, poolName, err)
 	}
 	return pool, nil
 }
@@ -95,6 +95,9 @@ func (d *Driver) getPool() (*libvirt.StoragePool, error) {
 	}
 	pool, err := conn.LookupStoragePoolByName(d.getStoragePoolName())
 	if err != nil {
+		if !isLibvirtErrorCode(err, libvirt.ERR_NO_STORAGE_POOL) {
+			return nil, err
+		}
 		log.Debugf("Could not find storage pool '%s', trying to create it", d.getStoragePoolName())
 		return d.createStoragePool()
 	}
@@ -103,7 +106,8 @@ func (d *Driver) getPool() (*libvirt.StoragePool, error) {
 	if active, _ := pool.IsActive(); !active {
 		err = d.activateStoragePool(pool)
 		if err != nil {
-			return nil, err
+			_ = pool.Free()
+			return nil, newError(ErrStoragePoolCreation, d.getStoragePoolName(), err)
 		}
 	}
 
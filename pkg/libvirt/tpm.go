@@ -0,0 +1,65 @@
+package libvirt
+
+import (
+	"os/exec"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+)
+
+// domainTPM returns an emulated TPM 2.0. libvirt runs swtpm for it, and keeps
+// its persistent state in a per-domain directory. The CRB interface is only
+// available on x86.
+func domainTPM(arch string) libvirtxml.DomainTPM {
+	model := "tpm-crb"
+	if arch == ArchAArch64 {
+		model = "tpm-tis-device"
+	}
+	return libvirtxml.DomainTPM{
+		Model: model,
+		Backend: &libvirtxml.DomainTPMBackend{
+			Emulator: &libvirtxml.DomainTPMBackendEmulator{
+				Version: "2.0",
+			},
+		},
+	}
+}
+
+func checkSwtpm() error {
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		return &CheckError{
+			Check:  "swtpm",
+			Reason: "swtpm was not found in $PATH, it's needed for the emulated TPM",
+			Hint:   "Install the swtpm package, or disable the TPM",
+		}
+	}
+	return nil
+}
+
+// undefineFlags returns the flags removing all the per-domain files libvirt
+// manages along with the domain definition
+func undefineFlags(tpm bool, libVersion uint32) libvirt.DomainUndefineFlagsValues {
+	// The NVRAM file is in the machine directory, but libvirt needs to be
+	// told it can delete it
+	flags := libvirt.DOMAIN_UNDEFINE_NVRAM
+	// Older versions reject the flag, and always remove the TPM state
+	if tpm && libVersion >= minLibvirtVersionUndefineTPM {
+		flags |= domainUndefineTPM
+	}
+	return flags
+}
+
+func (d *Driver) undefineFlags() libvirt.DomainUndefineFlagsValues {
+	var version uint32
+	if d.TPM {
+		conn, err := d.getConn()
+		if err == nil {
+			version, err = conn.GetLibVersion()
+		}
+		if err != nil {
+			log.Debugf("Failed to get libvirt version: %v", err)
+		}
+	}
+	return undefineFlags(d.TPM, version)
+}
@@ -0,0 +1,38 @@
+package libvirt
+
+import (
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTPMTemplating(t *testing.T) {
+	d := newTestDriver()
+	d.TPM = true
+
+	xml, err := domainXML(d, "q35")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<tpm model="tpm-crb">
+      <backend type="emulator" version="2.0"></backend>
+    </tpm>`)
+
+	d.arch = ArchAArch64
+	xml, err = domainXML(d, "virt")
+	assert.NoError(t, err)
+	assert.Contains(t, xml, `<tpm model="tpm-tis-device">
+      <backend type="emulator" version="2.0"></backend>
+    </tpm>`)
+}
+
+func TestUndefineFlags(t *testing.T) {
+	// VIR_DOMAIN_UNDEFINE_TPM from libvirt-domain.h
+	assert.Equal(t, libvirt.DomainUndefineFlagsValues(32), domainUndefineTPM)
+
+	flags := undefineFlags(true, minLibvirtVersionUndefineTPM)
+	assert.Equal(t, domainUndefineTPM, flags&domainUndefineTPM)
+	assert.Equal(t, libvirt.DOMAIN_UNDEFINE_NVRAM, flags&libvirt.DOMAIN_UNDEFINE_NVRAM)
+
+	assert.Equal(t, libvirt.DOMAIN_UNDEFINE_NVRAM, undefineFlags(true, 8008000))
+	assert.Equal(t, libvirt.DOMAIN_UNDEFINE_NVRAM, undefineFlags(false, minLibvirtVersionUndefineTPM))
+}
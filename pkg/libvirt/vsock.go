@@ -0,0 +1,209 @@
+package libvirt
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/libvirt/libvirt-go"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+func domainVSock(d *Driver) *libvirtxml.DomainVSock {
+	vsock := &libvirtxml.DomainVSock{
+		Model: "virtio",
+		CID: &libvirtxml.DomainVSockCID{
+			Auto: "yes",
+		},
+	}
+	if d.VSockCID != 0 {
+		vsock.CID = &libvirtxml.DomainVSockCID{
+			Auto:    "no",
+			Address: strconv.FormatUint(uint64(d.VSockCID), 10),
+		}
+	}
+	return vsock
+}
+
+// Context IDs 0 to 2 are reserved for the hypervisor and the host, and
+// 0xffffffff is VMADDR_CID_ANY
+const (
+	minVSockCID = 3
+	maxVSockCID = 0xfffffffe
+)
+
+func (d *Driver) checkVSock() error {
+	if d.VSockCID == 0 {
+		return nil
+	}
+	if d.VSockCID < minVSockCID || d.VSockCID > maxVSockCID {
+		return &CheckError{
+			Check:  "vsock",
+			Reason: fmt.Sprintf("vsock context ID %d is reserved", d.VSockCID),
+			Hint:   fmt.Sprintf("Use a context ID between %d and %d, or 0 to assign one automatically", minVSockCID, uint32(maxVSockCID)),
+		}
+	}
+	return nil
+}
+
+func vsockCIDFromXML(domainXML string) (uint32, error) {
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(domainXML); err != nil {
+		return 0, err
+	}
+	if domain.Devices == nil || domain.Devices.VSock == nil || domain.Devices.VSock.CID == nil {
+		return 0, fmt.Errorf("domain %s has no vsock device", domain.Name)
+	}
+	if domain.Devices.VSock.CID.Address == "" {
+		return 0, fmt.Errorf("domain %s has no vsock CID assigned, is it running?", domain.Name)
+	}
+	cid, err := strconv.ParseUint(domain.Devices.VSock.CID.Address, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vsock CID '%s': %w", domain.Devices.VSock.CID.Address, err)
+	}
+	return uint32(cid), nil
+}
+
+// GetVSockCID returns the vsock context ID assigned to the running VM
+func (d *Driver) GetVSockCID() (uint32, error) {
+	if err := d.validateVMRef(); err != nil {
+		return 0, err
+	}
+	xml, err := d.vm.GetXMLDesc(libvirt.DomainXMLFlags(0))
+	if err != nil {
+		return 0, err
+	}
+	return vsockCIDFromXML(xml)
+}
+
+// Timeout in milliseconds for the vsock connection to be established
+const vsockConnectTimeout = 10 * 1000
+
+// waitConnected waits for the non blocking connect of fd to complete
+func waitConnected(fd int) error {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+	for {
+		n, err := unix.Poll(fds, vsockConnectTimeout)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return unix.ETIMEDOUT
+		}
+		break
+	}
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return unix.Errno(errno)
+	}
+	return nil
+}
+
+// net.FileConn doesn't support AF_VSOCK sockets, the raw file is used
+// instead. The socket is non blocking so that os.NewFile uses the runtime
+// poller, and Close unblocks the pending reads.
+func dialVSock(cid, port uint32) (io.ReadWriteCloser, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port})
+	if err == unix.EINPROGRESS {
+		err = waitConnected(fd)
+	}
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("failed to connect to vsock %d:%d: %w", cid, port, err)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port)), nil
+}
+
+// VSockForwarder forwards the TCP connections accepted on a host address
+// to a vsock port in the guest
+type VSockForwarder struct {
+	listener net.Listener
+	cid      uint32
+	port     uint32
+	wg       sync.WaitGroup
+}
+
+// ForwardVSockPort listens on hostAddress and forwards the incoming
+// connections to guestPort over vsock, until the forwarder is closed
+func (d *Driver) ForwardVSockPort(hostAddress string, guestPort uint32) (*VSockForwarder, error) {
+	cid, err := d.GetVSockCID()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", hostAddress)
+	if err != nil {
+		return nil, err
+	}
+	forwarder := &VSockForwarder{
+		listener: listener,
+		cid:      cid,
+		port:     guestPort,
+	}
+	forwarder.wg.Add(1)
+	go forwarder.serve()
+	return forwarder, nil
+}
+
+// Addr returns the host address the forwarder listens on
+func (f *VSockForwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Close stops accepting new connections and waits for the accept loop to exit
+func (f *VSockForwarder) Close() error {
+	err := f.listener.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *VSockForwarder) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			log.Debugf("Stopping vsock forwarder on %s: %v", f.listener.Addr(), err)
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+func (f *VSockForwarder) forward(conn net.Conn) {
+	defer conn.Close()
+	guestConn, err := dialVSock(f.cid, f.port)
+	if err != nil {
+		log.Warnf("Failed to forward connection from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer guestConn.Close()
+	proxy(conn, guestConn)
+}
+
+// proxy copies data in both directions until one side is closed
+func proxy(a, b io.ReadWriter) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}